@@ -13,19 +13,20 @@ func CreateCommand() *cli.Command {
 		Usage: "Create a container",
 		Action: func(c *cli.Context) error {
 			if c.NArg() < 2 {
-				return cli.Exit("Please specify a container ID and bundle path", 1)
+				return cli.Exit("Please specify a container ID and bundle path", exitFailure)
 			}
 			containerID := c.Args().Get(0)
 			bundle := c.Args().Get(1)
 			logrus.Infof("Creating container %s from bundle %s", containerID, bundle)
-			container, err := container.NewContainer(containerID, bundle)
+			container, lock, err := container.NewContainer(containerID, bundle)
 			if err != nil {
-				return cli.Exit(err.Error(), 1)
+				return exitError("Failed to create container", err)
 			}
+			defer lock.Unlock()
 
 			err = container.Create()
 			if err != nil {
-				return cli.Exit(err.Error(), 1)
+				return exitError("Failed to create container", err)
 			}
 
 			logrus.Infof("Container created: %+v", container)
@@ -3,6 +3,7 @@ package commands
 import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"github.com/yoonhyunwoo/simcon/pkg/container"
 )
 
 // DeleteCommand deletes a container
@@ -12,10 +13,24 @@ func DeleteCommand() *cli.Command {
 		Usage: "Delete a container",
 		Action: func(c *cli.Context) error {
 			if c.NArg() < 1 {
-				return cli.Exit("Please specify a container ID", 1)
+				return cli.Exit("Please specify a container ID", exitFailure)
 			}
 			containerID := c.Args().Get(0)
 			logrus.Infof("Deleting container %s", containerID)
+
+			lock, err := container.NewStateManager().Lock(containerID)
+			if err != nil {
+				return exitError("Failed to lock container", err)
+			}
+			defer lock.Unlock()
+
+			container, err := container.LoadContainer(containerID)
+			if err != nil {
+				return exitError("Failed to load container", err)
+			}
+			if err := container.Delete(); err != nil {
+				return exitError("Failed to delete container", err)
+			}
 			return nil
 		},
 	}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/yoonhyunwoo/simcon/pkg/container"
+)
+
+// Exit codes telling callers why a command failed
+const (
+	exitFailure      = 1
+	exitNotExist     = 2
+	exitExist        = 3
+	exitInvalidState = 4
+	exitInvalidSpec  = 5
+	exitSyscall      = 6
+)
+
+// exitError reports err after msg with the exit code of its kind
+func exitError(msg string, err error) cli.ExitCoder {
+	return cli.Exit(fmt.Sprintf("%s: %v", msg, err), exitCode(err))
+}
+
+// exitCode returns the exit code for err
+func exitCode(err error) int {
+	var invalidState *container.ErrInvalidState
+	var syscallErr *container.SyscallError
+	switch {
+	case errors.Is(err, container.ErrNotExist):
+		return exitNotExist
+	case errors.Is(err, container.ErrExist):
+		return exitExist
+	case errors.As(err, &invalidState), errors.Is(err, container.ErrNotRunning):
+		return exitInvalidState
+	case errors.Is(err, container.ErrInvalidSpec):
+		return exitInvalidSpec
+	case errors.As(err, &syscallErr):
+		return exitSyscall
+	}
+	return exitFailure
+}
@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"github.com/yoonhyunwoo/simcon/pkg/container"
+)
+
+// GCCommand removes containers whose init is gone
+func GCCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "gc",
+		Usage: "Remove stale containers whose init is gone",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only print the stale containers",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			dryRun := c.Bool("dry-run")
+			logrus.Infof("Collecting stale containers")
+
+			stale, err := container.GarbageCollect(dryRun)
+			action := "Removed"
+			if dryRun {
+				action = "Would remove"
+			}
+			for _, s := range stale {
+				status := s.Status
+				if status == "" {
+					status = "no state"
+				}
+				fmt.Printf("%s container %s (%s)\n", action, s.ID, status)
+				for _, path := range []string{s.StateDir, s.CgroupPath, s.RecordDir} {
+					if path != "" {
+						fmt.Printf("  %s\n", path)
+					}
+				}
+			}
+
+			if err != nil {
+				return exitError("Failed to collect stale containers", err)
+			}
+			return nil
+		},
+	}
+}
@@ -3,6 +3,7 @@ package commands
 import (
 	"fmt"
 	"os"
+	"runtime"
 
 	"github.com/urfave/cli/v2"
 	"github.com/yoonhyunwoo/simcon/pkg/container"
@@ -14,6 +15,9 @@ func InitCommand() *cli.Command {
 		Name:  "init",
 		Usage: "Init a container",
 		Action: func(c *cli.Context) error {
+			// Namespace, credential and seccomp changes apply to the calling thread
+			runtime.LockOSThread()
+
 			// Get bundle path from environment
 			bundle := os.Getenv("_SIMCON_BUNDLE")
 			if bundle == "" {
@@ -21,23 +25,44 @@ func InitCommand() *cli.Command {
 			}
 
 			// Create container instance
-			container, err := container.NewContainer("", bundle)
+			container, err := container.NewInitContainer(os.Getenv("_SIMCON_ID"), bundle)
 			if err != nil {
-				return fmt.Errorf("failed to create container: %v", err)
+				return fmt.Errorf("failed to create container: %w", err)
 			}
 
-			// Setup mounts
-			if err := container.InitProcess.SetupMounts(); err != nil {
-				return fmt.Errorf("failed to setup mounts: %v", err)
+			// The runtime waits for the setup and fails create with our error
+			if err := initContainer(container); err != nil {
+				container.InitProcess.ReportError(err)
+				return err
 			}
+			return nil
+		},
+	}
+}
 
-			// Setup security configurations
-			if err := container.InitProcess.SetupSecurity(); err != nil {
-				return fmt.Errorf("failed to setup security: %v", err)
-			}
+// initContainer sets up the container in its init process and replaces the
+// init with the container process
+func initContainer(container *container.Container) error {
+	// Setup the namespaces the init creates itself
+	if err := container.InitProcess.SetupNamespaces(); err != nil {
+		return fmt.Errorf("failed to setup namespaces: %w", err)
+	}
 
-			// Run the container process
-			return container.InitProcess.CreateProcess()
-		},
+	// Setup mounts
+	if err := container.InitProcess.SetupMounts(); err != nil {
+		return fmt.Errorf("failed to setup mounts: %w", err)
+	}
+
+	// Setup hostname while we still hold CAP_SYS_ADMIN
+	if err := container.InitProcess.SetupHostname(); err != nil {
+		return fmt.Errorf("failed to setup hostname: %w", err)
 	}
+
+	// Setup security configurations
+	if err := container.InitProcess.SetupSecurity(); err != nil {
+		return fmt.Errorf("failed to setup security: %w", err)
+	}
+
+	// Replace the init with the container process
+	return container.InitProcess.ExecProcess()
 }
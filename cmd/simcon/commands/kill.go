@@ -5,6 +5,8 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"github.com/yoonhyunwoo/simcon/pkg/container"
+	"golang.org/x/sys/unix"
 )
 
 // KillCommand kills a container
@@ -14,15 +16,29 @@ func KillCommand() *cli.Command {
 		Usage: "Kill a container",
 		Action: func(c *cli.Context) error {
 			if c.NArg() < 2 {
-				return cli.Exit("Please specify a container ID and signal", 1)
+				return cli.Exit("Please specify a container ID and signal", exitFailure)
 			}
 			containerID := c.Args().Get(0)
 			signalStr := c.Args().Get(1)
 			signal, err := strconv.Atoi(signalStr)
 			if err != nil {
-				return cli.Exit("Invalid signal number", 1)
+				return cli.Exit("Invalid signal number", exitFailure)
 			}
 			logrus.Infof("Killing container %s with signal %d", containerID, signal)
+
+			lock, err := container.NewStateManager().Lock(containerID)
+			if err != nil {
+				return exitError("Failed to lock container", err)
+			}
+			defer lock.Unlock()
+
+			container, err := container.LoadContainer(containerID)
+			if err != nil {
+				return exitError("Failed to load container", err)
+			}
+			if err := container.Kill(unix.Signal(signal)); err != nil {
+				return exitError("Failed to kill container", err)
+			}
 			return nil
 		},
 	}
@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"github.com/yoonhyunwoo/simcon/pkg/container"
+	"github.com/yoonhyunwoo/simcon/pkg/filesystem"
+)
+
+// GlobalFlags are the flags shared by every command
+func GlobalFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "root",
+			Usage:   "root directory of the runtime, holding what it must find again after a reboot, such as the cgroups of its containers (default: /var/lib/simcon, or the data directory of an unprivileged user)",
+			EnvVars: []string{"SIMCON_ROOT"},
+		},
+		&cli.StringFlag{
+			Name:    "state-dir",
+			Usage:   "directory for container state (default: state below --root when it is set, otherwise /run/simcon or the runtime directory of an unprivileged user)",
+			EnvVars: []string{"SIMCON_STATE_DIR"},
+		},
+	}
+}
+
+// SetupRoot points the runtime at the directories selected by the global flags
+func SetupRoot(c *cli.Context) error {
+	root := c.String("root")
+	if root == "" {
+		root = defaultRoot()
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("invalid root directory: %v", err)
+	}
+	filesystem.RootDir = root
+
+	stateDir := c.String("state-dir")
+	if stateDir == "" && c.IsSet("root") {
+		stateDir = filepath.Join(root, "state")
+	}
+	if stateDir != "" {
+		if stateDir, err = filepath.Abs(stateDir); err != nil {
+			return fmt.Errorf("invalid state directory: %v", err)
+		}
+	}
+	container.StateDir = stateDir
+	return nil
+}
+
+// defaultRoot returns the runtime root, which for an unprivileged user is
+// below its data directory
+func defaultRoot() string {
+	if os.Geteuid() == 0 {
+		return filesystem.RootDir
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "simcon")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", "simcon")
+	}
+	return filesystem.RootDir
+}
@@ -1,8 +1,6 @@
 package commands
 
 import (
-	"fmt"
-
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"github.com/yoonhyunwoo/simcon/pkg/container"
@@ -15,23 +13,23 @@ func StartCommand() *cli.Command {
 		Usage: "Start a container",
 		Action: func(c *cli.Context) error {
 			if c.NArg() < 1 {
-				return cli.Exit("Please specify a container ID", 1)
+				return cli.Exit("Please specify a container ID", exitFailure)
 			}
 			containerID := c.Args().Get(0)
-			stateManager := container.NewStateManager()
-			state, err := stateManager.GetState(containerID)
+			lock, err := container.NewStateManager().Lock(containerID)
 			if err != nil {
-				return cli.Exit(fmt.Sprintf("Failed to get container state: %v", err), 1)
+				return exitError("Failed to lock container", err)
 			}
+			defer lock.Unlock()
 
-			container, err := container.NewContainer(containerID, state.Bundle)
+			container, err := container.LoadContainer(containerID)
 			if err != nil {
-				return cli.Exit(fmt.Sprintf("Failed to create container: %v", err), 1)
+				return exitError("Failed to load container", err)
 			}
 
 			err = container.Start()
 			if err != nil {
-				return cli.Exit(fmt.Sprintf("Failed to start container: %v", err), 1)
+				return exitError("Failed to start container", err)
 			}
 
 			logrus.Infof("Starting container %s", containerID)
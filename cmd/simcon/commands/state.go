@@ -1,8 +1,12 @@
 package commands
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"github.com/yoonhyunwoo/simcon/pkg/container"
 )
 
 // StateCommand gets container state
@@ -12,10 +16,20 @@ func StateCommand() *cli.Command {
 		Usage: "Get container state",
 		Action: func(c *cli.Context) error {
 			if c.NArg() < 1 {
-				return cli.Exit("Please specify a container ID", 1)
+				return cli.Exit("Please specify a container ID", exitFailure)
 			}
 			containerID := c.Args().Get(0)
 			logrus.Infof("Getting state for container %s", containerID)
+
+			container, err := container.LoadContainer(containerID)
+			if err != nil {
+				return exitError("Failed to load container", err)
+			}
+			data, err := json.MarshalIndent(container.OCIState(), "", "  ")
+			if err != nil {
+				return exitError("Failed to marshal state", err)
+			}
+			fmt.Println(string(data))
 			return nil
 		},
 	}
@@ -3,21 +3,38 @@ package main
 import (
 	"log"
 	"os"
+	"runtime"
 
 	"github.com/urfave/cli/v2"
 	"github.com/yoonhyunwoo/simcon/cmd/simcon/commands"
+
+	// Joins namespaces before the Go runtime starts in the init process
+	_ "github.com/yoonhyunwoo/simcon/pkg/nsenter"
 )
 
+func init() {
+	// The init process sets up namespaces and credentials per thread and
+	// writes /proc/self files that only apply to the main thread, so it has
+	// to stay on the main thread
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		runtime.LockOSThread()
+	}
+}
+
 func main() {
 	app := &cli.App{
-		Name:  "simcon",
-		Usage: "A simple OCI container runtime",
+		Name:   "simcon",
+		Usage:  "A simple OCI container runtime",
+		Flags:  commands.GlobalFlags(),
+		Before: commands.SetupRoot,
 		Commands: []*cli.Command{
 			commands.CreateCommand(),
 			commands.StartCommand(),
 			commands.KillCommand(),
 			commands.DeleteCommand(),
 			commands.StateCommand(),
+			commands.GCCommand(),
+			commands.InitCommand(),
 		},
 	}
 
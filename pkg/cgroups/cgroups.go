@@ -1,11 +1,14 @@
 package cgroups
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
 // CgroupManager handles cgroup operations
@@ -13,17 +16,57 @@ type CgroupManager struct {
 	Path string
 }
 
-// NewCgroupManager creates a new cgroup manager
-func NewCgroupManager(containerID string) *CgroupManager {
+// NewCgroupManager creates a new cgroup manager. The cgroup is created below
+// parent, which keeps the containers of one runtime instance apart from
+// those of others with the same IDs.
+func NewCgroupManager(parent, containerID string) *CgroupManager {
 	return &CgroupManager{
-		Path: filepath.Join("/sys/fs/cgroup", containerID),
+		Path: filepath.Join("/sys/fs/cgroup", parent, containerID),
 	}
 }
 
+// NewRootlessCgroupManager creates a cgroup manager for an unprivileged user.
+// The cgroup is created below parent in our own cgroup, which must be part of
+// a cgroup v2 subtree delegated to us.
+func NewRootlessCgroupManager(parent, containerID string) (*CgroupManager, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup", &st); err != nil {
+		return nil, fmt.Errorf("failed to stat /sys/fs/cgroup: %w", os.NewSyscallError("statfs", err))
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("cgroup v2 is required")
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read own cgroup: %w", syscallError(err))
+	}
+	var own string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			own = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if own == "" {
+		return nil, fmt.Errorf("failed to find own cgroup")
+	}
+
+	delegated := filepath.Join("/sys/fs/cgroup", own)
+	for _, path := range []string{delegated, filepath.Join(delegated, "cgroup.procs")} {
+		if err := unix.Access(path, unix.W_OK); err != nil {
+			return nil, fmt.Errorf("cgroup %s is not delegated to us", own)
+		}
+	}
+
+	return &CgroupManager{
+		Path: filepath.Join(delegated, parent, containerID),
+	}, nil
+}
+
 // Create creates a new cgroup
 func (m *CgroupManager) Create() error {
 	if err := os.MkdirAll(m.Path, 0755); err != nil {
-		return fmt.Errorf("failed to create cgroup: %v", err)
+		return fmt.Errorf("failed to create cgroup: %w", syscallError(err))
 	}
 	return nil
 }
@@ -31,19 +74,19 @@ func (m *CgroupManager) Create() error {
 // SetMemoryLimit sets the memory limit for the cgroup in bytes
 func (m *CgroupManager) SetMemoryLimit(limitInBytes int64) error {
 	path := filepath.Join(m.Path, "memory.limit_in_bytes")
-	return os.WriteFile(path, []byte(fmt.Sprintf("%d", limitInBytes)), 0644)
+	return writeFile(path, fmt.Sprintf("%d", limitInBytes))
 }
 
 // SetCPULimit sets the CPU shares for the cgroup (relative weight)
 func (m *CgroupManager) SetCPULimit(shares int) error {
 	path := filepath.Join(m.Path, "cpu.shares")
-	return os.WriteFile(path, []byte(fmt.Sprintf("%d", shares)), 0644)
+	return writeFile(path, fmt.Sprintf("%d", shares))
 }
 
 // SetPidsLimit sets the maximum number of processes allowed in the cgroup
 func (m *CgroupManager) SetPidsLimit(maxPids int) error {
 	path := filepath.Join(m.Path, "pids.max")
-	return os.WriteFile(path, []byte(fmt.Sprintf("%d", maxPids)), 0644)
+	return writeFile(path, fmt.Sprintf("%d", maxPids))
 }
 
 // SetBlockIO sets the block IO weight for the cgroup (10-1000)
@@ -52,13 +95,13 @@ func (m *CgroupManager) SetBlockIO(weight int) error {
 		return fmt.Errorf("block IO weight must be between 10 and 1000")
 	}
 	path := filepath.Join(m.Path, "blkio.weight")
-	return os.WriteFile(path, []byte(fmt.Sprintf("%d", weight)), 0644)
+	return writeFile(path, fmt.Sprintf("%d", weight))
 }
 
 // SetNetwork sets the network class ID for the cgroup
 func (m *CgroupManager) SetNetwork(classID uint32) error {
 	path := filepath.Join(m.Path, "net_cls.classid")
-	return os.WriteFile(path, []byte(fmt.Sprintf("0x%x", classID)), 0644)
+	return writeFile(path, fmt.Sprintf("0x%x", classID))
 }
 
 // SetDevices sets the device access permissions for the cgroup
@@ -66,8 +109,8 @@ func (m *CgroupManager) SetDevices(devices []specs.LinuxDeviceCgroup) error {
 	for _, device := range devices {
 		rule := fmt.Sprintf("%s %d:%d %s", device.Type, device.Major, device.Minor, device.Access)
 		path := filepath.Join(m.Path, "devices.allow")
-		if err := os.WriteFile(path, []byte(rule), 0644); err != nil {
-			return fmt.Errorf("failed to set device rule %s: %v", rule, err)
+		if err := writeFile(path, rule); err != nil {
+			return fmt.Errorf("failed to set device rule %s: %w", rule, err)
 		}
 	}
 	return nil
@@ -77,8 +120,8 @@ func (m *CgroupManager) SetDevices(devices []specs.LinuxDeviceCgroup) error {
 func (m *CgroupManager) SetHugepages(limits []specs.LinuxHugepageLimit) error {
 	for _, limit := range limits {
 		path := filepath.Join(m.Path, fmt.Sprintf("hugetlb.%s.limit_in_bytes", limit.Pagesize))
-		if err := os.WriteFile(path, []byte(fmt.Sprintf("%d", limit.Limit)), 0644); err != nil {
-			return fmt.Errorf("failed to set hugepage limit for %s: %v", limit.Pagesize, err)
+		if err := writeFile(path, fmt.Sprintf("%d", limit.Limit)); err != nil {
+			return fmt.Errorf("failed to set hugepage limit for %s: %w", limit.Pagesize, err)
 		}
 	}
 	return nil
@@ -88,8 +131,8 @@ func (m *CgroupManager) SetHugepages(limits []specs.LinuxHugepageLimit) error {
 func (m *CgroupManager) SetRdma(rdma map[string]specs.LinuxRdma) error {
 	for device, limit := range rdma {
 		path := filepath.Join(m.Path, fmt.Sprintf("rdma.%s.hca_handles", device))
-		if err := os.WriteFile(path, []byte(fmt.Sprintf("%d", limit.HcaHandles)), 0644); err != nil {
-			return fmt.Errorf("failed to set RDMA limit for %s: %v", device, err)
+		if err := writeFile(path, fmt.Sprintf("%d", limit.HcaHandles)); err != nil {
+			return fmt.Errorf("failed to set RDMA limit for %s: %w", device, err)
 		}
 	}
 	return nil
@@ -99,20 +142,35 @@ func (m *CgroupManager) SetRdma(rdma map[string]specs.LinuxRdma) error {
 func (m *CgroupManager) SetUnified(unified map[string]string) error {
 	for key, value := range unified {
 		path := filepath.Join(m.Path, key)
-		if err := os.WriteFile(path, []byte(value), 0644); err != nil {
-			return fmt.Errorf("failed to set unified limit %s: %v", key, err)
+		if err := writeFile(path, value); err != nil {
+			return fmt.Errorf("failed to set unified limit %s: %w", key, err)
 		}
 	}
 	return nil
 }
 
-// AddProcess adds a process to the cgroup
+// AddProcess adds a process with all its threads to the cgroup
 func (m *CgroupManager) AddProcess(pid int) error {
-	path := filepath.Join(m.Path, "tasks")
-	return os.WriteFile(path, []byte(fmt.Sprintf("%d", pid)), 0644)
+	path := filepath.Join(m.Path, "cgroup.procs")
+	return writeFile(path, fmt.Sprintf("%d", pid))
 }
 
 // Remove removes the cgroup
 func (m *CgroupManager) Remove() error {
-	return os.RemoveAll(m.Path)
+	return syscallError(os.RemoveAll(m.Path))
+}
+
+// writeFile writes data to the cgroup file at path
+func writeFile(path, data string) error {
+	return syscallError(os.WriteFile(path, []byte(data), 0644))
+}
+
+// syscallError turns the PathError of a file operation into a SyscallError
+// naming the path, so callers can tell the kernel refused the operation
+func syscallError(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return fmt.Errorf("%s: %w", pathErr.Path, os.NewSyscallError(pathErr.Op, pathErr.Err))
+	}
+	return err
 }
@@ -0,0 +1,109 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/gocapability/capability"
+	"golang.org/x/sys/unix"
+)
+
+// capabilityNames maps OCI capability names to their values
+var capabilityNames = func() map[string]capability.Cap {
+	names := make(map[string]capability.Cap)
+	for _, c := range capability.List() {
+		names["CAP_"+strings.ToUpper(c.String())] = c
+	}
+	return names
+}()
+
+// parseCapabilities converts capability names to values, skipping the
+// ones the running kernel does not know
+func parseCapabilities(names []string) ([]capability.Cap, error) {
+	var caps []capability.Cap
+	for _, name := range names {
+		c, ok := capabilityNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		if c > capability.CAP_LAST_CAP {
+			logrus.Warnf("capability %s is not supported by the running kernel, ignoring", name)
+			continue
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// validateCapabilities checks that every capability name in the spec is known
+func validateCapabilities(caps *specs.LinuxCapabilities) error {
+	for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Inheritable, caps.Permitted, caps.Ambient} {
+		for _, name := range set {
+			if _, ok := capabilityNames[name]; !ok {
+				return fmt.Errorf("unknown capability %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// newCapabilities builds the capability state described by the spec
+func newCapabilities(spec *specs.LinuxCapabilities) (capability.Capabilities, error) {
+	c, err := capability.NewPid2(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	c.Clear(capability.CAPS | capability.BOUNDS | capability.AMBS)
+
+	sets := map[capability.CapType][]string{
+		capability.BOUNDING:    spec.Bounding,
+		capability.EFFECTIVE:   spec.Effective,
+		capability.INHERITABLE: spec.Inheritable,
+		capability.PERMITTED:   spec.Permitted,
+		capability.AMBIENT:     spec.Ambient,
+	}
+	for which, names := range sets {
+		caps, err := parseCapabilities(names)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(which, caps...)
+	}
+	return c, nil
+}
+
+// applyBoundingSet drops the capabilities missing from the bounding set.
+// It must run before the user switch while CAP_SETPCAP is still effective.
+func (p *InitProcess) applyBoundingSet() error {
+	c, err := newCapabilities(p.Container.Spec.Process.Capabilities)
+	if err != nil {
+		return err
+	}
+	if err := c.Apply(capability.BOUNDS); err != nil {
+		return fmt.Errorf("failed to apply bounding set: %w", err)
+	}
+	return nil
+}
+
+// keepCapabilities keeps the permitted set across the switch to a non-root user
+func keepCapabilities() error {
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set keep capabilities: %w", os.NewSyscallError("prctl", err))
+	}
+	return nil
+}
+
+// setupCapabilities applies the effective, permitted, inheritable and ambient sets
+func (p *InitProcess) setupCapabilities() error {
+	c, err := newCapabilities(p.Container.Spec.Process.Capabilities)
+	if err != nil {
+		return err
+	}
+	if err := c.Apply(capability.CAPS | capability.AMBS); err != nil {
+		return fmt.Errorf("failed to apply capabilities: %w", err)
+	}
+	return nil
+}
@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
 	"github.com/yoonhyunwoo/simcon/pkg/cgroups"
+	"github.com/yoonhyunwoo/simcon/pkg/seccomp"
 	"golang.org/x/sys/unix"
 )
 
@@ -162,214 +163,458 @@ type ThrottleDevice struct {
 	Rate  uint64
 }
 
-// NewContainer creates a new container instance from an OCI bundle
-func NewContainer(id, bundle string) (*Container, error) {
+// NewContainer creates a new container instance from an OCI bundle. Its
+// state is returned locked, the caller creates the container and unlocks it.
+func NewContainer(id, bundle string) (_ *Container, _ *StateLock, err error) {
+	if err := validateID(id); err != nil {
+		return nil, nil, err
+	}
+
 	spec, err := loadSpec(bundle)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load spec: %v", err)
+		return nil, nil, fmt.Errorf("failed to load spec: %w", err)
+	}
+
+	if rootless() {
+		if err := configureRootless(spec, true); err != nil {
+			return nil, nil, fmt.Errorf("failed to configure rootless mode: %w", err)
+		}
+	}
+	if err := mergeHookConfigs(spec, HookDirs); err != nil {
+		return nil, nil, fmt.Errorf("failed to load hook configs: %w", err)
 	}
 
 	stateManager := NewStateManager()
-	state, err := stateManager.CreateState(id, bundle)
+	state, lock, err := stateManager.CreateState(id, bundle)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create state: %v", err)
+		return nil, nil, fmt.Errorf("failed to create state: %w", err)
 	}
+	// The ID stays taken as long as the state exists
+	defer func() {
+		if err != nil {
+			stateManager.DeleteState(id)
+			lock.Unlock()
+		}
+	}()
 
-	container := &Container{
-		ID:     id,
-		Bundle: bundle,
-		Process: &Process{
-			ID:   -1,
-			Args: spec.Process.Args,
-			Env:  spec.Process.Env,
-			User: &User{
-				UID:            spec.Process.User.UID,
-				GID:            spec.Process.User.GID,
-				AdditionalGids: spec.Process.User.AdditionalGids,
-			},
-			Capabilities: &Capabilities{
+	return newContainer(id, bundle, spec, state), lock, nil
+}
+
+// NewInitContainer loads a container in its init process. The runtime owns
+// the state, so the state is kept in memory only.
+func NewInitContainer(id, bundle string) (_ *Container, err error) {
+	// The runtime waits on the sync socket, which also tells it why we failed
+	sync, err := inheritedFile("_SIMCON_SYNC")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			sendError(sync, err)
+			sync.Close()
+		}
+	}()
+	if err := checkNamespacesJoined(); err != nil {
+		return nil, err
+	}
+
+	spec, err := loadSpec(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spec: %w", err)
+	}
+	if rootless() {
+		if err := configureRootless(spec, false); err != nil {
+			return nil, fmt.Errorf("failed to configure rootless mode: %w", err)
+		}
+	}
+	if path := os.Getenv("_SIMCON_HOOKS"); path != "" {
+		if spec.Hooks, err = readHooks(path); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &ContainerState{
+		Version: specs.Version,
+		ID:      id,
+		Status:  StateCreating,
+		Bundle:  bundle,
+	}
+	container := newContainer(id, bundle, spec, state)
+	container.InitProcess.sync = sync
+	return container, nil
+}
+
+// newContainer builds a container from its spec and state
+func newContainer(id, bundle string, spec *specs.Spec, state *ContainerState) *Container {
+	process := &Process{ID: -1}
+	if spec.Process != nil {
+		process.Args = spec.Process.Args
+		process.Env = spec.Process.Env
+		process.User = &User{
+			UID:            spec.Process.User.UID,
+			GID:            spec.Process.User.GID,
+			AdditionalGids: spec.Process.User.AdditionalGids,
+		}
+		if spec.Process.Capabilities != nil {
+			process.Capabilities = &Capabilities{
 				Bounding:    spec.Process.Capabilities.Bounding,
 				Effective:   spec.Process.Capabilities.Effective,
 				Inheritable: spec.Process.Capabilities.Inheritable,
 				Permitted:   spec.Process.Capabilities.Permitted,
 				Ambient:     spec.Process.Capabilities.Ambient,
-			},
-		},
-		State: state,
-		Spec:  spec,
+			}
+		}
+	}
+
+	container := &Container{
+		ID:      id,
+		Bundle:  bundle,
+		Process: process,
+		State:   state,
+		Spec:    spec,
 	}
 
 	container.InitProcess = NewInitProcess(container)
-	return container, nil
+	return container
 }
 
-// Create creates a new container instance
-func (c *Container) Create() error {
-	stateManager := NewStateManager()
+// LoadContainer loads an existing container from its state
+func LoadContainer(id string) (*Container, error) {
+	state, err := NewStateManager().GetState(id)
+	if err != nil {
+		return nil, err
+	}
+	return loadContainer(state)
+}
 
-	// Create cgroup
-	cgroupManager := cgroups.NewCgroupManager(c.ID)
-	err := cgroupManager.Create()
+// loadContainer builds a container from its state and bundle
+func loadContainer(state *ContainerState) (*Container, error) {
+	id := state.ID
+	spec, err := loadSpec(state.Bundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spec: %w", err)
+	}
+	if rootless() {
+		if err := configureRootless(spec, true); err != nil {
+			return nil, fmt.Errorf("failed to configure rootless mode: %w", err)
+		}
+	}
 
-	if c.Spec.Linux.Resources.Memory != nil && c.Spec.Linux.Resources.Memory.Limit != nil {
-		cgroupManager.SetMemoryLimit(*c.Spec.Linux.Resources.Memory.Limit)
+	hooksPath, err := NewStateManager().hooksPath(id)
+	if err != nil {
+		return nil, err
 	}
-	if c.Spec.Linux.Resources.CPU != nil && c.Spec.Linux.Resources.CPU.Shares != nil {
-		cgroupManager.SetCPULimit(int(*c.Spec.Linux.Resources.CPU.Shares))
+	if _, err := os.Stat(hooksPath); err == nil {
+		if spec.Hooks, err = readHooks(hooksPath); err != nil {
+			return nil, err
+		}
 	}
-	if c.Spec.Linux.Resources.Pids != nil {
-		cgroupManager.SetPidsLimit(int(c.Spec.Linux.Resources.Pids.Limit))
+
+	container := newContainer(id, state.Bundle, spec, state)
+	if state.PID > 0 {
+		container.Process.ID = state.PID
 	}
-	if c.Spec.Linux.Resources.BlockIO != nil && c.Spec.Linux.Resources.BlockIO.Weight != nil {
-		cgroupManager.SetBlockIO(int(*c.Spec.Linux.Resources.BlockIO.Weight))
+	container.refreshStatus()
+	return container, nil
+}
+
+// refreshStatus marks the container stopped once its init is gone. The PID
+// alone is not enough, as another process may have reused it.
+func (c *Container) refreshStatus() {
+	if c.State.Status != StateCreated && c.State.Status != StateRunning {
+		return
 	}
-	if c.Spec.Linux.Resources.Network != nil && c.Spec.Linux.Resources.Network.ClassID != nil {
-		cgroupManager.SetNetwork(uint32(*c.Spec.Linux.Resources.Network.ClassID))
+	if !c.initRunning() {
+		c.State.Status = StateStopped
 	}
-	if c.Spec.Linux.Resources.Devices != nil {
-		cgroupManager.SetDevices(c.Spec.Linux.Resources.Devices)
+}
+
+// initRunning reports whether the container's init process is still running
+func (c *Container) initRunning() bool {
+	return c.Process.ID > 0 && isProcess(c.Process.ID, c.State.InitStartTime)
+}
+
+// Create creates a new container instance. A container that fails to create
+// leaves nothing behind, so its ID can be used again.
+func (c *Container) Create() (err error) {
+	stateManager := NewStateManager()
+	defer func() {
+		if err == nil {
+			return
+		}
+		c.InitProcess.abort()
+		stateManager.removeRecorded(c.ID, c.State.CgroupPath)
+		stateManager.DeleteState(c.ID)
+	}()
+
+	// Create cgroup
+	cgroupManager, err := c.setupCgroup(stateManager)
+	if err != nil {
+		return fmt.Errorf("failed to create cgroup: %w", err)
 	}
-	if c.Spec.Linux.Resources.HugepageLimits != nil {
-		cgroupManager.SetHugepages(c.Spec.Linux.Resources.HugepageLimits)
+
+	// Validate namespaces, the init process creates or joins them
+	if err := validateNamespaces(c.Spec); err != nil {
+		return invalidSpec("namespaces", err)
 	}
-	if c.Spec.Linux.Resources.Rdma != nil {
-		cgroupManager.SetRdma(c.Spec.Linux.Resources.Rdma)
+	if err := validateIDMappings(c.Spec); err != nil {
+		return invalidSpec("namespaces", err)
 	}
-	if c.Spec.Linux.Resources.Unified != nil {
-		cgroupManager.SetUnified(c.Spec.Linux.Resources.Unified)
+
+	// Validate the hostname, the init process sets it
+	if err := validateHostname(c.Spec); err != nil {
+		return invalidSpec("hostname", err)
 	}
 
-	if err != nil {
-		return fmt.Errorf("failed to create cgroup: %v", err)
+	// Validate sysctls, the init process applies them
+	if err := validateSysctl(c.Spec); err != nil {
+		return invalidSpec("sysctl", err)
 	}
 
 	// Setup mounts
 	if c.Spec.Mounts != nil {
 		for _, mount := range c.Spec.Mounts {
 			if err := setupMount(mount); err != nil {
-				return fmt.Errorf("failed to setup mount %s: %v", mount.Destination, err)
+				return fmt.Errorf("failed to setup mount %s: %w", mount.Destination, err)
 			}
 		}
 	}
 
 	// Setup security configurations
 	if c.Spec.Process != nil {
-		// Setup capabilities
+		// Validate capabilities, the init process applies them
 		if c.Spec.Process.Capabilities != nil {
-			if err := setupCapabilities(c.Spec.Process.Capabilities); err != nil {
-				return fmt.Errorf("failed to setup capabilities: %v", err)
+			if err := validateCapabilities(c.Spec.Process.Capabilities); err != nil {
+				return invalidSpec("capabilities", err)
 			}
 		}
 
-		// Setup seccomp
+		// Compile seccomp to validate it, the init process loads it
 		if c.Spec.Linux != nil && c.Spec.Linux.Seccomp != nil {
-			if err := setupSeccomp(c.Spec.Linux.Seccomp); err != nil {
-				return fmt.Errorf("failed to setup seccomp: %v", err)
+			if _, err := seccomp.Compile(c.Spec.Linux.Seccomp); err != nil {
+				return invalidSpec("seccomp", err)
 			}
 		}
 
-		// Setup rlimits
+		// Validate rlimits, the init process applies them
 		if c.Spec.Process.Rlimits != nil {
-			if err := setupRlimits(c.Spec.Process.Rlimits); err != nil {
-				return fmt.Errorf("failed to setup rlimits: %v", err)
+			if err := validateRlimits(c.Spec.Process.Rlimits); err != nil {
+				return invalidSpec("rlimits", err)
 			}
 		}
 	}
 
-	// Execute prestart hooks
-	if err := c.executeHooks(c.Spec.Hooks.Prestart); err != nil {
-		return fmt.Errorf("prestart hooks failed: %v", err)
+	// Persist the hooks merged from the hook directories for the init and
+	// later operations
+	if err := stateManager.saveHooks(c.ID, c.Spec.Hooks); err != nil {
+		return err
+	}
+	if c.InitProcess.hooksPath, err = stateManager.hooksPath(c.ID); err != nil {
+		return err
 	}
 
-	// Execute createRuntime hooks
-	if err := c.executeHooks(c.Spec.Hooks.CreateRuntime); err != nil {
-		return fmt.Errorf("createRuntime hooks failed: %v", err)
+	// The init waits on the exec fifo until start
+	execFifoPath, err := stateManager.execFifoPath(c.ID)
+	if err != nil {
+		return err
 	}
+	execFifo, err := createExecFifo(execFifoPath)
+	if err != nil {
+		return err
+	}
+	defer execFifo.Close()
+	c.InitProcess.execFifo = execFifo
 
-	// Execute createContainer hooks
-	if err := c.executeHooks(c.Spec.Hooks.CreateContainer); err != nil {
-		return fmt.Errorf("createContainer hooks failed: %v", err)
+	if c.State.Rootfs, err = c.InitProcess.rootfsPath(); err != nil {
+		return err
 	}
 
 	// Start init process
 	if err := c.InitProcess.Start(); err != nil {
-		return fmt.Errorf("failed to start init process: %v", err)
+		return fmt.Errorf("failed to start init process: %w", err)
+	}
+	if err := c.setupInit(cgroupManager); err != nil {
+		return c.InitProcess.initFailed(err)
 	}
 
 	c.State.Status = StateCreated
+	c.State.PID = c.Process.ID
+	return stateManager.UpdateState(c.State)
+}
 
-	// Execute poststart hooks
-	if err := c.executeHooks(c.Spec.Hooks.Poststart); err != nil {
-		// Log warning but continue
-		fmt.Printf("warning: poststart hooks failed: %v\n", err)
+// setupInit steps the init process through its setup until it waits for
+// start, running the runtime's create hooks once its mounts are in place
+func (c *Container) setupInit(cgroupManager *cgroups.CgroupManager) error {
+	// Remember the start time to tell the init apart from a later process
+	// with the same PID
+	startTime, err := processStartTime(c.Process.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read init start time: %w", err)
 	}
+	c.State.InitStartTime = startTime
 
-	return stateManager.UpdateState(c.State)
+	// Place the init in its cgroup before it sets up its cgroup namespace
+	if cgroupManager != nil {
+		if err := cgroupManager.AddProcess(c.Process.ID); err != nil {
+			return fmt.Errorf("failed to add init process to cgroup: %w", err)
+		}
+	}
+	if err := c.InitProcess.Resume(); err != nil {
+		return err
+	}
+
+	if err := readSync(c.InitProcess.sync, syncMountsReady); err != nil {
+		return fmt.Errorf("init process failed: %w", err)
+	}
+
+	// Execute prestart hooks in the runtime namespace now that the container
+	// namespaces exist
+	if err := c.executeHooks("prestart", c.Spec.Hooks.Prestart); err != nil {
+		return err
+	}
+
+	// Execute createRuntime hooks
+	if err := c.executeHooks("createRuntime", c.Spec.Hooks.CreateRuntime); err != nil {
+		return err
+	}
+
+	// The init runs the createContainer hooks itself
+	if err := writeSync(c.InitProcess.sync, syncHooksDone); err != nil {
+		return err
+	}
+	if err := readSync(c.InitProcess.sync, syncCreated); err != nil {
+		return fmt.Errorf("init process failed: %w", err)
+	}
+	return nil
+}
+
+// setupCgroup creates the container cgroup and applies its resources. The
+// cgroup is recorded before it is created. In rootless mode it returns nil
+// when no cgroup v2 subtree is delegated to us.
+func (c *Container) setupCgroup(stateManager *StateManager) (*cgroups.CgroupManager, error) {
+	cgroupManager := cgroups.NewCgroupManager(stateManager.instanceName(), c.ID)
+	if rootless() {
+		m, err := cgroups.NewRootlessCgroupManager(stateManager.instanceName(), c.ID)
+		if err != nil {
+			logrus.Warnf("rootless: skipping cgroup setup: %v", err)
+			return nil, nil
+		}
+		cgroupManager = m
+	}
+	if err := stateManager.saveRecord(&containerRecord{ID: c.ID, CgroupPath: cgroupManager.Path}); err != nil {
+		return nil, err
+	}
+	c.State.CgroupPath = cgroupManager.Path
+
+	err := cgroupManager.Create()
+	if c.Spec.Linux == nil || c.Spec.Linux.Resources == nil {
+		return cgroupManager, err
+	}
+
+	if c.Spec.Linux.Resources.Memory != nil && c.Spec.Linux.Resources.Memory.Limit != nil {
+		cgroupManager.SetMemoryLimit(*c.Spec.Linux.Resources.Memory.Limit)
+	}
+	if c.Spec.Linux.Resources.CPU != nil && c.Spec.Linux.Resources.CPU.Shares != nil {
+		cgroupManager.SetCPULimit(int(*c.Spec.Linux.Resources.CPU.Shares))
+	}
+	if c.Spec.Linux.Resources.Pids != nil {
+		cgroupManager.SetPidsLimit(int(c.Spec.Linux.Resources.Pids.Limit))
+	}
+	if c.Spec.Linux.Resources.BlockIO != nil && c.Spec.Linux.Resources.BlockIO.Weight != nil {
+		cgroupManager.SetBlockIO(int(*c.Spec.Linux.Resources.BlockIO.Weight))
+	}
+	if c.Spec.Linux.Resources.Network != nil && c.Spec.Linux.Resources.Network.ClassID != nil {
+		cgroupManager.SetNetwork(uint32(*c.Spec.Linux.Resources.Network.ClassID))
+	}
+	if c.Spec.Linux.Resources.Devices != nil {
+		cgroupManager.SetDevices(c.Spec.Linux.Resources.Devices)
+	}
+	if c.Spec.Linux.Resources.HugepageLimits != nil {
+		cgroupManager.SetHugepages(c.Spec.Linux.Resources.HugepageLimits)
+	}
+	if c.Spec.Linux.Resources.Rdma != nil {
+		cgroupManager.SetRdma(c.Spec.Linux.Resources.Rdma)
+	}
+	if c.Spec.Linux.Resources.Unified != nil {
+		cgroupManager.SetUnified(c.Spec.Linux.Resources.Unified)
+	}
+
+	return cgroupManager, err
 }
 
 // Start starts the container process
 func (c *Container) Start() error {
 	if c.State.Status != StateCreated {
-		return fmt.Errorf("container must be in created state to start")
+		return &ErrInvalidState{From: c.State.Status, To: StateRunning}
 	}
 
 	stateManager := NewStateManager()
 
-	// Execute startContainer hooks
-	if err := c.executeHooks(c.Spec.Hooks.StartContainer); err != nil {
-		return fmt.Errorf("startContainer hooks failed: %v", err)
+	// Release the init, which runs the startContainer hooks and executes the
+	// container process
+	execFifoPath, err := stateManager.execFifoPath(c.ID)
+	if err != nil {
+		return err
 	}
-
-	// Start the container process
-	cmd := exec.Command(c.Spec.Process.Args[0], c.Spec.Process.Args[1:]...)
-	cmd.SysProcAttr = &unix.SysProcAttr{
-		Cloneflags: unix.CLONE_NEWUTS | unix.CLONE_NEWPID | unix.CLONE_NEWNS,
+	started, err := waitForExec(execFifoPath, c.Process.ID, c.State.InitStartTime)
+	if err != nil {
+		return err
 	}
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start container: %v", err)
+	if !started {
+		c.State.Status = StateStopped
+		stateManager.UpdateState(c.State)
+		return fmt.Errorf("container process failed to start")
 	}
 
-	c.Process.ID = cmd.Process.Pid
 	c.State.Status = StateRunning
+	if err := stateManager.UpdateState(c.State); err != nil {
+		return err
+	}
 
 	// Execute poststart hooks
-	if err := c.executeHooks(c.Spec.Hooks.Poststart); err != nil {
+	if err := c.executeHooks("poststart", c.Spec.Hooks.Poststart); err != nil {
 		// Log warning but continue
-		fmt.Printf("warning: poststart hooks failed: %v\n", err)
+		logrus.Warnf("Container %s: %v", c.ID, err)
 	}
 
-	return stateManager.UpdateState(c.State)
+	return nil
 }
 
 // Kill sends a signal to the container process
 func (c *Container) Kill(signal unix.Signal) error {
 	if c.State.Status != StateCreated && c.State.Status != StateRunning {
-		return fmt.Errorf("container must be in created or running state to kill")
+		return &ErrInvalidState{From: c.State.Status, To: StateStopped}
 	}
 
 	if c.Process.ID == -1 {
-		return fmt.Errorf("container is not running")
+		return ErrNotRunning
 	}
 
-	return unix.Kill(c.Process.ID, signal)
+	return signalProcess(c.Process.ID, c.State.InitStartTime, signal)
 }
 
 // Delete removes the container
 func (c *Container) Delete() error {
 	if c.State.Status != StateStopped {
-		return fmt.Errorf("container must be in stopped state to delete")
+		return &ErrInvalidState{From: c.State.Status, To: "deleted"}
 	}
 
+	// Remove the cgroup first, so a failure leaves the state to retry with
 	stateManager := NewStateManager()
+	if err := stateManager.removeRecorded(c.ID, c.State.CgroupPath); err != nil {
+		return err
+	}
+	if err := stateManager.DeleteState(c.ID); err != nil {
+		return err
+	}
 
-	// Execute poststop hooks
-	if err := c.executeHooks(c.Spec.Hooks.Poststop); err != nil {
+	// Execute poststop hooks once the container is gone
+	if err := c.executeHooks("poststop", c.Spec.Hooks.Poststop); err != nil {
 		// Log warning but continue
-		fmt.Printf("warning: poststop hooks failed: %v\n", err)
+		logrus.Warnf("Container %s: %v", c.ID, err)
 	}
 
-	return stateManager.DeleteState(c.ID)
+	return nil
 }
 
 // loadSpec loads the OCI spec from the bundle
@@ -377,55 +622,23 @@ func loadSpec(bundle string) (*specs.Spec, error) {
 	configPath := filepath.Join(bundle, "config.json")
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config.json: %v", err)
+		return nil, fmt.Errorf("failed to read config.json: %w", err)
 	}
 
 	var spec specs.Spec
 	if err := json.Unmarshal(data, &spec); err != nil {
-		return nil, fmt.Errorf("failed to parse config.json: %v", err)
+		return nil, fmt.Errorf("%w: failed to parse config.json: %w", ErrInvalidSpec, err)
+	}
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
 	}
 
 	return &spec, nil
 }
 
-// executeHooks executes a list of hooks
-func (c *Container) executeHooks(hooks []specs.Hook) error {
-	for _, hook := range hooks {
-		cmd := exec.Command(hook.Path, hook.Args...)
-		cmd.Env = hook.Env
-		cmd.Dir = c.Bundle
-
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("hook %s failed: %v", hook.Path, err)
-		}
-	}
-	return nil
-}
-
 // setupMount sets up a filesystem mount
 func setupMount(mount specs.Mount) error {
 	// Implementation for mounting filesystems
 	// This is a placeholder for the actual implementation
 	return nil
 }
-
-// setupCapabilities sets up process capabilities
-func setupCapabilities(caps *specs.LinuxCapabilities) error {
-	// Implementation for setting up capabilities
-	// This is a placeholder for the actual implementation
-	return nil
-}
-
-// setupSeccomp sets up seccomp filters
-func setupSeccomp(seccomp *specs.LinuxSeccomp) error {
-	// Implementation for setting up seccomp
-	// This is a placeholder for the actual implementation
-	return nil
-}
-
-// setupRlimits sets up resource limits
-func setupRlimits(rlimits []specs.POSIXRlimit) error {
-	// Implementation for setting up resource limits
-	// This is a placeholder for the actual implementation
-	return nil
-}
@@ -0,0 +1,212 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// defaultDeviceMode is the permission of the default devices
+var defaultDeviceMode os.FileMode = 0666
+
+// defaultDevices are the devices every container gets
+var defaultDevices = []specs.LinuxDevice{
+	{Path: "/dev/null", Type: "c", Major: 1, Minor: 3, FileMode: &defaultDeviceMode},
+	{Path: "/dev/zero", Type: "c", Major: 1, Minor: 5, FileMode: &defaultDeviceMode},
+	{Path: "/dev/full", Type: "c", Major: 1, Minor: 7, FileMode: &defaultDeviceMode},
+	{Path: "/dev/random", Type: "c", Major: 1, Minor: 8, FileMode: &defaultDeviceMode},
+	{Path: "/dev/urandom", Type: "c", Major: 1, Minor: 9, FileMode: &defaultDeviceMode},
+	{Path: "/dev/tty", Type: "c", Major: 5, Minor: 0, FileMode: &defaultDeviceMode},
+}
+
+// defaultPtsMount is the /dev/pts mount of containers whose spec mounts /dev
+// but not /dev/pts
+var defaultPtsMount = specs.Mount{
+	Destination: "/dev/pts",
+	Type:        "devpts",
+	Source:      "devpts",
+	Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"},
+}
+
+// devSymlinks are the standard symlinks created in /dev
+var devSymlinks = [][2]string{
+	{"/proc/self/fd", "/dev/fd"},
+	{"/proc/self/fd/0", "/dev/stdin"},
+	{"/proc/self/fd/1", "/dev/stdout"},
+	{"/proc/self/fd/2", "/dev/stderr"},
+	{"pts/ptmx", "/dev/ptmx"},
+}
+
+// setupDev populates /dev below rootfs with the default and spec devices
+func (p *InitProcess) setupDev(rootfs string) error {
+	devMounted := p.hasMount("/dev")
+
+	// Devices cannot be created inside a user namespace, bind them from the host instead
+	bind := p.hasNamespace(specs.UserNamespace)
+
+	devices := defaultDevices
+	if p.Container.Spec.Linux != nil {
+		devices = append(append([]specs.LinuxDevice{}, defaultDevices...), p.Container.Spec.Linux.Devices...)
+	}
+	for _, d := range devices {
+		if err := createDevice(rootfs, d, bind); err != nil {
+			return fmt.Errorf("failed to create device %s: %w", d.Path, err)
+		}
+	}
+
+	// A bare rootfs /dev is left as the image provides it
+	if !devMounted {
+		return nil
+	}
+
+	if !p.hasMount("/dev/pts") {
+		if err := mountToRootfs(rootfs, p.Container.Bundle, defaultPtsMount); err != nil {
+			return fmt.Errorf("failed to mount /dev/pts: %w", err)
+		}
+	}
+
+	if !p.hasMount("/dev/shm") {
+		shm, err := resolveInRoot(rootfs, "/dev/shm")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(shm, 0755); err != nil {
+			return fmt.Errorf("failed to create /dev/shm: %w", err)
+		}
+		if err := unix.Mount("shm", shm, "tmpfs", unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV, "mode=1777,size=65536k"); err != nil {
+			return fmt.Errorf("failed to mount /dev/shm: %w", os.NewSyscallError("mount", err))
+		}
+	}
+
+	for _, link := range devSymlinks {
+		dir, err := resolveInRoot(rootfs, filepath.Dir(link[1]))
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, filepath.Base(link[1]))
+		if err := os.Symlink(link[0], dest); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create symlink %s: %w", link[1], err)
+		}
+	}
+	return nil
+}
+
+// createDevice creates a device node below rootfs, or binds the host device when bind is set
+func createDevice(rootfs string, d specs.LinuxDevice, bind bool) error {
+	dir, err := resolveInRoot(rootfs, filepath.Dir(d.Path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	mode, err := deviceMode(d)
+	if err != nil {
+		return err
+	}
+
+	if bind {
+		if err := checkHostDevice(d, mode); err != nil {
+			return err
+		}
+		dest, err := resolveInRoot(rootfs, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := createMountPoint(dest, false); err != nil {
+			return err
+		}
+		return os.NewSyscallError("mount", unix.Mount(d.Path, dest, "", unix.MS_BIND, ""))
+	}
+
+	// The node replaces whatever the image has at its path, without
+	// following a symlink there
+	dest := filepath.Join(dir, filepath.Base(d.Path))
+
+	perm := os.FileMode(0666)
+	if d.FileMode != nil {
+		perm = d.FileMode.Perm()
+	}
+
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := unix.Mknod(dest, mode|uint32(perm), int(unix.Mkdev(uint32(d.Major), uint32(d.Minor)))); err != nil {
+		return os.NewSyscallError("mknod", err)
+	}
+
+	// mknod is subject to the umask, so set the mode explicitly
+	if err := os.Chmod(dest, perm); err != nil {
+		return err
+	}
+
+	uid, gid := 0, 0
+	if d.UID != nil {
+		uid = int(*d.UID)
+	}
+	if d.GID != nil {
+		gid = int(*d.GID)
+	}
+	return os.Lchown(dest, uid, gid)
+}
+
+// deviceMode returns the file type of a device
+func deviceMode(d specs.LinuxDevice) (uint32, error) {
+	switch d.Type {
+	case "c", "u":
+		return unix.S_IFCHR, nil
+	case "b":
+		return unix.S_IFBLK, nil
+	case "p":
+		return unix.S_IFIFO, nil
+	}
+	return 0, fmt.Errorf("unknown device type %q", d.Type)
+}
+
+// checkHostDevice checks that the host node bound for d is the device the
+// spec describes
+func checkHostDevice(d specs.LinuxDevice, mode uint32) error {
+	var st unix.Stat_t
+	if err := unix.Stat(d.Path, &st); err != nil {
+		if err == unix.ENOENT {
+			return fmt.Errorf("no host device at %s to bind in a user namespace", d.Path)
+		}
+		return fmt.Errorf("failed to stat host device: %w", os.NewSyscallError("stat", err))
+	}
+
+	if st.Mode&unix.S_IFMT != mode {
+		return fmt.Errorf("host %s is not a device of type %s", d.Path, d.Type)
+	}
+	if mode == unix.S_IFIFO {
+		return nil
+	}
+	major, minor := unix.Major(st.Rdev), unix.Minor(st.Rdev)
+	if int64(major) != d.Major || int64(minor) != d.Minor {
+		return fmt.Errorf("host device %s is %d:%d, the spec asks for %d:%d", d.Path, major, minor, d.Major, d.Minor)
+	}
+	return nil
+}
+
+// ptsOptions completes the options of a devpts mount so it gets its own
+// instance of devpts with a ptmx /dev/ptmx can point to
+func ptsOptions(options []string) []string {
+	var newInstance, ptmxMode bool
+	for _, o := range options {
+		newInstance = newInstance || o == "newinstance"
+		ptmxMode = ptmxMode || strings.HasPrefix(o, "ptmxmode=")
+	}
+
+	options = append([]string{}, options...)
+	if !newInstance {
+		options = append(options, "newinstance")
+	}
+	if !ptmxMode {
+		options = append(options, "ptmxmode=0666")
+	}
+	return options
+}
@@ -0,0 +1,44 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNotExist is returned for a container ID without state
+	ErrNotExist = errors.New("container does not exist")
+	// ErrExist is returned when creating a container whose ID is taken
+	ErrExist = errors.New("container already exists")
+	// ErrNotRunning is returned when signalling a container whose init
+	// process has exited
+	ErrNotRunning = errors.New("container is not running")
+	// ErrInvalidSpec is returned when the spec of a bundle is malformed or
+	// asks for something the runtime cannot do
+	ErrInvalidSpec = errors.New("invalid spec")
+)
+
+// ErrInvalidState is returned when an operation does not apply to the
+// container in its current status
+type ErrInvalidState struct {
+	// From is the status of the container
+	From string
+	// To is the status the operation would move the container to, or
+	// deleted for delete
+	To string
+}
+
+func (e *ErrInvalidState) Error() string {
+	return fmt.Sprintf("container is %s and cannot become %s", e.From, e.To)
+}
+
+// SyscallError is a system call the kernel refused. It is the os type, so
+// the errors of the cgroups and filesystem packages match as well.
+type SyscallError = os.SyscallError
+
+// invalidSpec marks err, found validating the named part of the spec, as
+// ErrInvalidSpec
+func invalidSpec(what string, err error) error {
+	return fmt.Errorf("%w: %s: %w", ErrInvalidSpec, what, err)
+}
@@ -0,0 +1,226 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StaleContainer is a container whose init is gone, or what is left of one
+// whose state was lost, e.g. on reboot
+type StaleContainer struct {
+	ID string
+	// Status is the last recorded status, empty when the state was lost
+	Status string
+
+	// The paths the runtime recorded, empty when there is nothing to remove
+	StateDir   string
+	CgroupPath string
+	RecordDir  string
+
+	container *Container
+}
+
+// GarbageCollect finds stale containers and removes them: their cgroups,
+// records and state are removed, then their poststop hooks run. Containers
+// whose state was lost are found by their records below the runtime root.
+// Only the paths the runtime recorded are removed. With dryRun the stale
+// containers are only reported. Containers locked by another simcon
+// invocation are in use and skipped.
+func GarbageCollect(dryRun bool) ([]*StaleContainer, error) {
+	stateManager := NewStateManager()
+	entries, err := os.ReadDir(stateManager.RootDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read state directory: %w", err)
+	}
+
+	var stale []*StaleContainer
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id := entry.Name()
+
+		s, err := collectContainer(stateManager, id, dryRun)
+		if s != nil {
+			stale = append(stale, s)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", id, err))
+		}
+	}
+
+	ids, err := stateManager.recordedIDs()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, id := range ids {
+		s, err := collectLeftover(stateManager, id, dryRun)
+		if s != nil {
+			stale = append(stale, s)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", id, err))
+		}
+	}
+
+	return stale, errors.Join(errs...)
+}
+
+// collectContainer checks the container id under its lock and removes it
+// when its init is gone. It returns nil when the container is alive or busy.
+func collectContainer(stateManager *StateManager, id string, dryRun bool) (*StaleContainer, error) {
+	lock, ok, err := stateManager.TryLock(id)
+	if err != nil || !ok {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	// Without state the container is still being created, its creator writes
+	// the state once it holds the lock
+	state, err := stateManager.GetState(id)
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.PID > 0 && isProcess(state.PID, state.InitStartTime) {
+		return nil, nil
+	}
+
+	stateDir, err := stateManager.dir(id)
+	if err != nil {
+		return nil, err
+	}
+
+	recordDir, err := stateManager.recordDir(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StaleContainer{
+		ID:         id,
+		Status:     state.Status,
+		StateDir:   stateDir,
+		CgroupPath: existingPath(state.CgroupPath),
+		RecordDir:  existingPath(recordDir),
+	}
+
+	// The bundle may be gone as well, then there are no hooks to run
+	if s.container, err = loadContainer(state); err != nil {
+		logrus.Warnf("Not running poststop hooks of container %s: %v", id, err)
+		s.container = nil
+	}
+
+	if dryRun {
+		return s, nil
+	}
+	return s, s.remove(stateManager)
+}
+
+// collectLeftover removes what the record of a container without state
+// lists. It returns nil when the container has state, which
+// collectContainer takes care of. Meanwhile it holds the state directory,
+// which keeps the ID from being created anew.
+func collectLeftover(stateManager *StateManager, id string, dryRun bool) (*StaleContainer, error) {
+	stateDir, err := stateManager.dir(id)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		if _, err := os.Stat(stateDir); !os.IsNotExist(err) {
+			return nil, nil
+		}
+	} else {
+		if err := os.MkdirAll(stateManager.RootDir, 0711); err != nil {
+			return nil, fmt.Errorf("failed to create state root: %w", err)
+		}
+		if err := os.Mkdir(stateDir, 0755); err != nil {
+			if os.IsExist(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to create state directory: %w", err)
+		}
+		defer os.Remove(stateDir)
+	}
+
+	record, err := stateManager.readRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	recordDir, err := stateManager.recordDir(id)
+	if err != nil {
+		return nil, err
+	}
+	s := &StaleContainer{
+		ID:         id,
+		CgroupPath: existingPath(record.CgroupPath),
+		RecordDir:  recordDir,
+	}
+
+	// Without state there is no init to check, a process in the cgroup
+	// tells the container is still alive
+	if s.CgroupPath != "" && !cgroupEmpty(s.CgroupPath) {
+		return nil, fmt.Errorf("cgroup %s of a container without state still has processes", s.CgroupPath)
+	}
+
+	if dryRun {
+		return s, nil
+	}
+	return s, s.remove(stateManager)
+}
+
+// remove removes what is left of the container and runs its poststop hooks
+func (s *StaleContainer) remove(stateManager *StateManager) error {
+	var errs []error
+	if err := stateManager.removeRecorded(s.ID, s.CgroupPath); err != nil {
+		errs = append(errs, err)
+	}
+	if s.StateDir != "" {
+		if err := os.RemoveAll(s.StateDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove state: %w", err))
+		}
+	}
+
+	// Execute poststop hooks once the container is gone
+	if s.container != nil {
+		s.container.State.Status = StateStopped
+		if err := s.container.executeHooks("poststop", s.container.Spec.Hooks.Poststop); err != nil {
+			logrus.Warnf("Container %s: %v", s.ID, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// existingPath returns path if it exists, and an empty string otherwise
+func existingPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// cgroupEmpty reports whether no live process is in the cgroup at path
+func cgroupEmpty(path string) bool {
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return false
+	}
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil || !processExited(pid) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// hookWaitDelay is how long a hook's output is waited for once it exited or
+// was killed, in case it left children holding it open
+const hookWaitDelay = time.Second
+
+// hookState returns the state passed to hooks on stdin
+func (c *Container) hookState() ([]byte, error) {
+	return json.Marshal(c.OCIState())
+}
+
+// executeHooks runs the hooks of a lifecycle phase in order from the bundle
+func (c *Container) executeHooks(phase string, hooks []specs.Hook) error {
+	return c.executeHooksIn(phase, hooks, c.Bundle)
+}
+
+// executeHooksIn runs the hooks of a lifecycle phase in order from dir
+func (c *Container) executeHooksIn(phase string, hooks []specs.Hook, dir string) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	state, err := c.hookState()
+	if err != nil {
+		return fmt.Errorf("failed to marshal state for %s hooks: %w", phase, err)
+	}
+
+	for i, hook := range hooks {
+		if err := runHook(hook, state, dir); err != nil {
+			return fmt.Errorf("%s hook #%d (%s) failed: %w", phase, i, hook.Path, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs a hook with the state on stdin, killing it after its timeout,
+// and logs its output
+func runHook(hook specs.Hook, state []byte, dir string) error {
+	ctx := context.Background()
+	if hook.Timeout != nil {
+		if *hook.Timeout <= 0 {
+			return fmt.Errorf("timeout must be positive")
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*hook.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Path)
+	// The hook args include argv[0]
+	if len(hook.Args) > 0 {
+		cmd.Args = hook.Args
+	}
+	// Hooks get their own environment only, never the runtime's
+	cmd.Env = append([]string{}, hook.Env...)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(state)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = hookWaitDelay
+
+	err := cmd.Run()
+	logHookOutput(hook.Path, &stdout, logrus.InfoLevel)
+	logHookOutput(hook.Path, &stderr, logrus.WarnLevel)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %ds", *hook.Timeout)
+	}
+	return err
+}
+
+// logHookOutput writes each line a hook printed to the runtime log
+func logHookOutput(path string, output *bytes.Buffer, level logrus.Level) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		logrus.WithField("hook", path).Log(level, scanner.Text())
+	}
+}
+
+// runCreateHooks lets the runtime run the createRuntime hooks and then runs
+// the createContainer hooks. It runs in the init before pivoting.
+func (p *InitProcess) runCreateHooks() error {
+	if err := writeSync(p.sync, syncMountsReady); err != nil {
+		return err
+	}
+	if err := readSync(p.sync, syncHooksDone); err != nil {
+		return err
+	}
+	return p.Container.executeHooks("createContainer", p.Container.Spec.Hooks.CreateContainer)
+}
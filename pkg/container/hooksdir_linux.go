@@ -0,0 +1,208 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// HookDirs are the directories searched for hook configuration files. A file
+// overrides a file with the same name in an earlier directory.
+var HookDirs = []string{
+	"/usr/share/containers/oci/hooks.d",
+	"/etc/containers/oci/hooks.d",
+}
+
+// hookConfigVersion is the supported version of hook configuration files
+const hookConfigVersion = "1.0.0"
+
+// hookConfig is a hook configuration file in the oci-hooks.d format
+type hookConfig struct {
+	Version string     `json:"version"`
+	Hook    specs.Hook `json:"hook"`
+	When    hookWhen   `json:"when"`
+	Stages  []string   `json:"stages"`
+}
+
+// hookWhen holds the conditions under which a hook is injected. The hook
+// applies when any of them matches.
+type hookWhen struct {
+	Always        *bool             `json:"always,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	Commands      []string          `json:"commands,omitempty"`
+	HasBindMounts *bool             `json:"hasBindMounts,omitempty"`
+}
+
+// hookStage returns the hooks of the spec for a stage name
+func hookStage(hooks *specs.Hooks, stage string) *[]specs.Hook {
+	switch stage {
+	case "prestart":
+		return &hooks.Prestart
+	case "createRuntime":
+		return &hooks.CreateRuntime
+	case "createContainer":
+		return &hooks.CreateContainer
+	case "startContainer":
+		return &hooks.StartContainer
+	case "poststart":
+		return &hooks.Poststart
+	case "poststop":
+		return &hooks.Poststop
+	}
+	return nil
+}
+
+// mergeHookConfigs appends the hooks configured in dirs whose conditions
+// match the spec to the spec's hooks, in the order of their file names
+func mergeHookConfigs(spec *specs.Spec, dirs []string) error {
+	configs, err := loadHookConfigs(dirs)
+	if err != nil {
+		return err
+	}
+
+	for _, config := range configs {
+		match, err := config.When.match(spec)
+		if err != nil {
+			return fmt.Errorf("hook %s: %w", config.Hook.Path, err)
+		}
+		if !match {
+			continue
+		}
+		for _, stage := range config.Stages {
+			hooks := hookStage(spec.Hooks, stage)
+			*hooks = append(*hooks, config.Hook)
+		}
+	}
+	return nil
+}
+
+// loadHookConfigs reads the hook configuration files of dirs
+func loadHookConfigs(dirs []string) ([]hookConfig, error) {
+	paths := make(map[string]string)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hook directory %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+				paths[entry.Name()] = filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	configs := make([]hookConfig, 0, len(names))
+	for _, name := range names {
+		config, err := loadHookConfig(paths[name])
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// loadHookConfig reads and validates a hook configuration file
+func loadHookConfig(path string) (hookConfig, error) {
+	var config hookConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read hook config %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse hook config %s: %w", path, err)
+	}
+
+	if config.Version != hookConfigVersion {
+		return config, fmt.Errorf("hook config %s: unsupported version %q", path, config.Version)
+	}
+	if config.Hook.Path == "" {
+		return config, fmt.Errorf("hook config %s: missing hook path", path)
+	}
+	if len(config.Stages) == 0 {
+		return config, fmt.Errorf("hook config %s: missing stages", path)
+	}
+	for _, stage := range config.Stages {
+		if hookStage(&specs.Hooks{}, stage) == nil {
+			return config, fmt.Errorf("hook config %s: unknown stage %q", path, stage)
+		}
+	}
+	when := config.When
+	if when.Always == nil && when.HasBindMounts == nil && len(when.Annotations) == 0 && len(when.Commands) == 0 {
+		return config, fmt.Errorf("hook config %s: missing when conditions", path)
+	}
+	return config, nil
+}
+
+// match reports whether the conditions match the spec
+func (w hookWhen) match(spec *specs.Spec) (bool, error) {
+	if w.Always != nil && *w.Always {
+		return true, nil
+	}
+
+	if w.HasBindMounts != nil && *w.HasBindMounts && hasBindMounts(spec) {
+		return true, nil
+	}
+
+	for keyPattern, valuePattern := range w.Annotations {
+		for key, value := range spec.Annotations {
+			keyMatch, err := regexp.MatchString(keyPattern, key)
+			if err != nil {
+				return false, fmt.Errorf("invalid annotation pattern %q: %w", keyPattern, err)
+			}
+			if !keyMatch {
+				continue
+			}
+			valueMatch, err := regexp.MatchString(valuePattern, value)
+			if err != nil {
+				return false, fmt.Errorf("invalid annotation pattern %q: %w", valuePattern, err)
+			}
+			if valueMatch {
+				return true, nil
+			}
+		}
+	}
+
+	if spec.Process != nil && len(spec.Process.Args) > 0 {
+		for _, pattern := range w.Commands {
+			match, err := regexp.MatchString(pattern, spec.Process.Args[0])
+			if err != nil {
+				return false, fmt.Errorf("invalid command pattern %q: %w", pattern, err)
+			}
+			if match {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// hasBindMounts reports whether the spec has bind mounts
+func hasBindMounts(spec *specs.Spec) bool {
+	for _, m := range spec.Mounts {
+		if m.Type == "bind" {
+			return true
+		}
+		for _, o := range m.Options {
+			if o == "bind" || o == "rbind" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// validateIDMappings checks that mappings come with a new user namespace
+func validateIDMappings(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		return nil
+	}
+	hasMappings := len(spec.Linux.UIDMappings) > 0 || len(spec.Linux.GIDMappings) > 0
+	if hasMappings && !ownsNamespace(spec, specs.UserNamespace) {
+		return fmt.Errorf("uid and gid mappings require a new user namespace")
+	}
+	for _, m := range append(spec.Linux.UIDMappings, spec.Linux.GIDMappings...) {
+		if m.Size == 0 {
+			return fmt.Errorf("mapping of container id %d has size 0", m.ContainerID)
+		}
+	}
+	return nil
+}
+
+// mapsOnlySelf reports whether mappings map a single id to the given host id,
+// which an unprivileged process may write itself
+func mapsOnlySelf(mappings []specs.LinuxIDMapping, id int) bool {
+	return len(mappings) == 0 || (len(mappings) == 1 && mappings[0].Size == 1 && int(mappings[0].HostID) == id)
+}
+
+// toSysProcIDMaps converts OCI mappings for SysProcAttr
+func toSysProcIDMaps(mappings []specs.LinuxIDMapping) []syscall.SysProcIDMap {
+	maps := make([]syscall.SysProcIDMap, len(mappings))
+	for i, m := range mappings {
+		maps[i] = syscall.SysProcIDMap{
+			ContainerID: int(m.ContainerID),
+			HostID:      int(m.HostID),
+			Size:        int(m.Size),
+		}
+	}
+	return maps
+}
+
+// setupIDMappings arranges for the mappings of a new user namespace to be
+// written. When we may write them ourselves the kernel setup is left to
+// SysProcAttr, which holds the child back until the maps are in place.
+// Otherwise it returns true and the maps are written with the setuid
+// newuidmap and newgidmap helpers once the init has started, while the init
+// still waits on the sync pipe.
+func (p *InitProcess) setupIDMappings(attr *syscall.SysProcAttr) bool {
+	spec := p.Container.Spec
+	if !ownsNamespace(spec, specs.UserNamespace) {
+		return false
+	}
+
+	uidMappings, gidMappings := spec.Linux.UIDMappings, spec.Linux.GIDMappings
+	euid, egid := os.Geteuid(), os.Getegid()
+	if euid != 0 && (!mapsOnlySelf(uidMappings, euid) || !mapsOnlySelf(gidMappings, egid)) {
+		return true
+	}
+
+	attr.UidMappings = toSysProcIDMaps(uidMappings)
+	attr.GidMappings = toSysProcIDMaps(gidMappings)
+	// Without privileges gid_map can only be written once setgroups is denied
+	attr.GidMappingsEnableSetgroups = euid == 0
+
+	// Our host ids are usually unmapped in the new namespace, and exec drops
+	// the capabilities of an unmapped user, so become root there first
+	if mapsRoot(uidMappings) && mapsRoot(gidMappings) {
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: euid != 0}
+	}
+	return false
+}
+
+// mapUserNamespace writes the mappings of the user namespace pkg/nsenter
+// created for pid, with the helpers when we may not write them ourselves
+func mapUserNamespace(pid int, spec *specs.Spec) error {
+	uidMappings, gidMappings := spec.Linux.UIDMappings, spec.Linux.GIDMappings
+	euid, egid := os.Geteuid(), os.Getegid()
+	if euid != 0 && (!mapsOnlySelf(uidMappings, euid) || !mapsOnlySelf(gidMappings, egid)) {
+		return writeIDMappings(pid, spec)
+	}
+
+	// Without privileges gid_map can only be written once setgroups is denied
+	if euid != 0 {
+		if err := writeProcFile(pid, "setgroups", "deny"); err != nil {
+			return err
+		}
+	}
+	if err := writeProcFile(pid, "uid_map", formatIDMap(uidMappings)); err != nil {
+		return err
+	}
+	return writeProcFile(pid, "gid_map", formatIDMap(gidMappings))
+}
+
+// formatIDMap formats mappings as the kernel reads them from uid_map
+func formatIDMap(mappings []specs.LinuxIDMapping) string {
+	var data strings.Builder
+	for _, m := range mappings {
+		fmt.Fprintf(&data, "%d %d %d\n", m.ContainerID, m.HostID, m.Size)
+	}
+	return data.String()
+}
+
+// writeProcFile writes data to the /proc file name of pid, unless data is empty
+func writeProcFile(pid int, name, data string) error {
+	if data == "" {
+		return nil
+	}
+	path := fmt.Sprintf("/proc/%d/%s", pid, name)
+	if err := os.WriteFile(path, []byte(data), 0); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// mapsRoot reports whether mappings map id 0 of the namespace
+func mapsRoot(mappings []specs.LinuxIDMapping) bool {
+	for _, m := range mappings {
+		if m.ContainerID == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reexecIfMapped re-executes the init once the runtime wrote its mappings
+// with the helpers. The init was exec'd before its user was mapped and lost
+// its capabilities then; as the namespace root it gets them back on exec.
+func reexecIfMapped() error {
+	if os.Getenv("_SIMCON_REEXEC") != "1" {
+		return nil
+	}
+	os.Setenv("_SIMCON_REEXEC", "done")
+
+	if err := syscall.Exec("/proc/self/exe", os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to re-exec init: %w", os.NewSyscallError("execve", err))
+	}
+	return nil
+}
+
+// writeIDMappings writes the mappings of the init's user namespace with
+// newuidmap and newgidmap
+func writeIDMappings(pid int, spec *specs.Spec) error {
+	if err := runIDMapHelper("newuidmap", pid, spec.Linux.UIDMappings); err != nil {
+		return err
+	}
+	return runIDMapHelper("newgidmap", pid, spec.Linux.GIDMappings)
+}
+
+// runIDMapHelper runs a newuidmap style helper for pid
+func runIDMapHelper(helper string, pid int, mappings []specs.LinuxIDMapping) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+	path, err := exec.LookPath(helper)
+	if err != nil {
+		return fmt.Errorf("%s is required for these mappings: %w", helper, err)
+	}
+
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range mappings {
+		args = append(args,
+			strconv.FormatUint(uint64(m.ContainerID), 10),
+			strconv.FormatUint(uint64(m.HostID), 10),
+			strconv.FormatUint(uint64(m.Size), 10))
+	}
+	if out, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", helper, err, out)
+	}
+	return nil
+}
@@ -2,17 +2,32 @@ package container
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/yoonhyunwoo/simcon/pkg/seccomp"
 	"golang.org/x/sys/unix"
 )
 
+// defaultPath is used to find the container process when the spec sets no PATH
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
 // InitProcess represents the container's init process
 type InitProcess struct {
 	Container *Container
 	cmd       *exec.Cmd
+	hostPID   int
+	sync      *os.File
+	execFifo  *os.File
+	hooksPath string
+
+	seccomp         *seccomp.Filter
+	seccompListener *net.UnixConn
 }
 
 // NewInitProcess creates a new init process
@@ -26,61 +41,225 @@ func NewInitProcess(container *Container) *InitProcess {
 func (p *InitProcess) Start() error {
 	p.cmd = exec.Command("/proc/self/exe", "init")
 
-	// Set up namespace flags based on the container spec
-	var cloneFlags uintptr
-	if p.Container.Spec.Linux != nil && p.Container.Spec.Linux.Namespaces != nil {
-		for _, ns := range p.Container.Spec.Linux.Namespaces {
-			switch ns.Type {
-			case "pid":
-				cloneFlags |= unix.CLONE_NEWPID
-			case "network":
-				cloneFlags |= unix.CLONE_NEWNET
-			case "mount":
-				cloneFlags |= unix.CLONE_NEWNS
-			case "uts":
-				cloneFlags |= unix.CLONE_NEWUTS
-			case "ipc":
-				cloneFlags |= unix.CLONE_NEWIPC
-			case "user":
-				cloneFlags |= unix.CLONE_NEWUSER
-			}
-		}
+	// Namespaces with a path are joined by pkg/nsenter, the rest are created
+	// by clone. With joins nsenter creates them too, after joining: a user
+	// namespace created by clone would own the init and make the joins fail.
+	cloneFlags, joins, err := p.namespaces()
+	if err != nil {
+		return err
+	}
+	var nsenterFlags uintptr
+	if len(joins) > 0 {
+		nsenterFlags, cloneFlags = cloneFlags, 0
 	}
 
 	p.cmd.SysProcAttr = &unix.SysProcAttr{
 		Cloneflags: cloneFlags,
 	}
-	p.cmd.Env = append(os.Environ(), fmt.Sprintf("_SIMCON_BUNDLE=%s", p.Container.Bundle))
+	useIDMapHelpers := false
+	if len(joins) == 0 {
+		useIDMapHelpers = p.setupIDMappings(p.cmd.SysProcAttr)
+	}
 
-	if err := p.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start init process: %v", err)
+	// The container process inherits the runtime's stdio
+	p.cmd.Stdin = os.Stdin
+	p.cmd.Stdout = os.Stdout
+	p.cmd.Stderr = os.Stderr
+	p.cmd.Env = append(os.Environ(),
+		fmt.Sprintf("_SIMCON_BUNDLE=%s", p.Container.Bundle),
+		fmt.Sprintf("_SIMCON_ID=%s", p.Container.ID),
+	)
+	if useIDMapHelpers {
+		p.cmd.Env = append(p.cmd.Env, "_SIMCON_REEXEC=1")
+	}
+	if rootless() {
+		p.cmd.Env = append(p.cmd.Env, "_SIMCON_ROOTLESS=1")
+	}
+	if p.hooksPath != "" {
+		p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("_SIMCON_HOOKS=%s", p.hooksPath))
+	}
+
+	// The runtime and the init step through the setup over the sync socket
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create sync socket: %w", os.NewSyscallError("socketpair", err))
+	}
+	p.sync = os.NewFile(uintptr(fds[0]), "sync")
+	syncChild := os.NewFile(uintptr(fds[1]), "sync")
+	defer syncChild.Close()
+	p.passFile("_SIMCON_SYNC", syncChild)
+
+	// The init opens the exec fifo to wait for start
+	if p.execFifo != nil {
+		p.passFile("_SIMCON_FIFOFD", p.execFifo)
+	}
+
+	// nsenter asks for the mappings of a user namespace it created over its
+	// own socket, and reports the real PID of the init when it forks for a
+	// PID namespace
+	var nsSync, nsSyncChild *os.File
+	if len(joins) > 0 {
+		p.cmd.Env = append(p.cmd.Env,
+			fmt.Sprintf("_SIMCON_NSPATHS=%s", nsenterEnv(joins)),
+			fmt.Sprintf("_SIMCON_NSUNSHARE=%d", nsenterFlags),
+		)
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			p.sync.Close()
+			return fmt.Errorf("failed to create nsenter socket: %w", os.NewSyscallError("socketpair", err))
+		}
+		nsSync = os.NewFile(uintptr(fds[0]), "nssync")
+		defer nsSync.Close()
+		nsSyncChild = os.NewFile(uintptr(fds[1]), "nssync")
+		p.passFile("_SIMCON_NSSYNC", nsSyncChild)
+	}
+
+	err = p.cmd.Start()
+	if nsSyncChild != nil {
+		nsSyncChild.Close()
+	}
+	if err != nil {
+		p.sync.Close()
+		return fmt.Errorf("failed to start init process: %w", err)
 	}
 
 	p.Container.Process.ID = p.cmd.Process.Pid
+	if nsSync != nil {
+		if err := p.syncNsenter(nsSync); err != nil {
+			p.abort()
+			return err
+		}
+	}
+
+	if useIDMapHelpers {
+		if err := writeIDMappings(p.Container.Process.ID, p.Container.Spec); err != nil {
+			p.abort()
+			return err
+		}
+	}
 
 	return nil
 }
 
+// passFile passes f to the init process and names its descriptor in env
+func (p *InitProcess) passFile(env string, f *os.File) {
+	p.cmd.ExtraFiles = append(p.cmd.ExtraFiles, f)
+	p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("%s=%d", env, 2+len(p.cmd.ExtraFiles)))
+}
+
+// Resume lets the init process continue once it has been placed in its cgroup
+func (p *InitProcess) Resume() error {
+	return writeSync(p.sync, syncResume)
+}
+
+// abort kills an init process that failed to set up. It does nothing when
+// the init was not started or was waited for already.
+func (p *InitProcess) abort() {
+	if p.sync != nil {
+		p.sync.Close()
+		p.sync = nil
+	}
+	if p.cmd == nil || p.cmd.Process == nil || p.cmd.ProcessState != nil {
+		return
+	}
+	// When nsenter forked for a PID namespace, the process we started only
+	// mirrors the exit of the init, which is its child
+	if pid := p.Container.Process.ID; pid > 0 && pid != p.cmd.Process.Pid {
+		killChild(pid, p.cmd.Process.Pid)
+	}
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
 // Wait waits for the init process to complete
 func (p *InitProcess) Wait() error {
 	return p.cmd.Wait()
 }
 
-// SetupMounts sets up the container mounts
+// SetupMounts sets up the container mounts and switches into the container root
 func (p *InitProcess) SetupMounts() error {
+	if !p.hasNamespace(specs.MountNamespace) {
+		return fmt.Errorf("a mount namespace is required to set up the container root")
+	}
+
+	rootfs, err := p.rootfsPath()
+	if err != nil {
+		return err
+	}
+
+	// Connect to the seccomp agent while the host filesystem is still reachable
+	if err := p.connectSeccompListener(); err != nil {
+		return err
+	}
+
+	// Set the propagation of / before anything is mounted
+	if err := p.setupRootPropagation(); err != nil {
+		return err
+	}
+	if err := makeParentMountPrivate(rootfs); err != nil {
+		return err
+	}
+	if err := unix.Mount(rootfs, rootfs, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount rootfs: %w", os.NewSyscallError("mount", err))
+	}
+
 	// First, mount proc
-	if err := unix.Mount("proc", "/proc", "proc", 0, ""); err != nil {
-		return fmt.Errorf("failed to mount proc: %v", err)
+	if !p.hasMount("/proc") {
+		proc, err := resolveInRoot(rootfs, "/proc")
+		if err != nil {
+			return err
+		}
+		if err := unix.Mount("proc", proc, "proc", 0, ""); err != nil {
+			return fmt.Errorf("failed to mount proc: %w", os.NewSyscallError("mount", err))
+		}
 	}
 
 	// Then mount other filesystems
 	if p.Container.Spec.Mounts != nil {
 		for _, mount := range p.Container.Spec.Mounts {
-			if err := unix.Mount(mount.Source, mount.Destination, mount.Type, 0, ""); err != nil {
-				return fmt.Errorf("failed to mount %s: %v", mount.Destination, err)
+			if err := mountToRootfs(rootfs, p.Container.Bundle, mount); err != nil {
+				return fmt.Errorf("failed to mount %s: %w", mount.Destination, err)
+			}
+		}
+	}
+
+	if err := p.setupDev(rootfs); err != nil {
+		return err
+	}
+
+	// Let the runtime run the createRuntime hooks, then run the createContainer
+	// hooks in the container namespaces while host paths still resolve
+	if err := p.runCreateHooks(); err != nil {
+		return err
+	}
+
+	if err := pivotRoot(rootfs); err != nil {
+		return err
+	}
+
+	if p.Container.Spec.Linux != nil {
+		if err := p.setupSysctl(); err != nil {
+			return err
+		}
+
+		for _, path := range p.Container.Spec.Linux.ReadonlyPaths {
+			if err := readonlyPath(path); err != nil {
+				return err
+			}
+		}
+		for _, path := range p.Container.Spec.Linux.MaskedPaths {
+			if err := maskPath(path); err != nil {
+				return err
 			}
 		}
 	}
+
+	// Make the root read-only once every mount is in place
+	if p.Container.Spec.Root.Readonly {
+		if err := remountReadonly("/"); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -90,98 +269,153 @@ func (p *InitProcess) SetupSecurity() error {
 		return nil
 	}
 
-	// Setup capabilities
-	if p.Container.Spec.Process.Capabilities != nil {
-		if err := p.setupCapabilities(); err != nil {
-			return fmt.Errorf("failed to setup capabilities: %v", err)
-		}
-	}
-
-	// Setup seccomp
+	// Compile seccomp before anything changes so spec errors surface early
 	if p.Container.Spec.Linux != nil && p.Container.Spec.Linux.Seccomp != nil {
 		if err := p.setupSeccomp(); err != nil {
-			return fmt.Errorf("failed to setup seccomp: %v", err)
+			return fmt.Errorf("failed to setup seccomp: %w", err)
 		}
 	}
 
-	// Setup rlimits
+	// Setup process attributes that may need privileges
+	if err := p.setupProcessAttributes(); err != nil {
+		return err
+	}
+
+	// Setup rlimits before the user switch so hard limits can be raised
 	if p.Container.Spec.Process.Rlimits != nil {
 		if err := p.setupRlimits(); err != nil {
-			return fmt.Errorf("failed to setup rlimits: %v", err)
+			return fmt.Errorf("failed to setup rlimits: %w", err)
 		}
 	}
 
-	return nil
-}
-
-func (p *InitProcess) setupCapabilities() error {
-
-	return nil
-}
+	// Drop the bounding set while CAP_SETPCAP is still effective
+	if p.Container.Spec.Process.Capabilities != nil {
+		if err := p.applyBoundingSet(); err != nil {
+			return fmt.Errorf("failed to setup capabilities: %w", err)
+		}
+	}
 
-func (p *InitProcess) setupSeccomp() error {
-	// Implementation for setting up seccomp
-	// This is a placeholder for the actual implementation
-	return nil
-}
+	if err := keepCapabilities(); err != nil {
+		return err
+	}
 
-func (p *InitProcess) setupRlimits() error {
-	// Implementation for setting up rlimits
-	// This is a placeholder for the actual implementation
-	return nil
-}
+	// Without no_new_privs loading a filter needs CAP_SYS_ADMIN, so load it
+	// before the user switch and capabilities take it away
+	if p.seccomp != nil && !p.Container.Spec.Process.NoNewPrivileges {
+		if err := p.loadSeccomp(); err != nil {
+			return fmt.Errorf("failed to setup seccomp: %w", err)
+		}
+		p.seccomp = nil
+	}
 
-func (p *InitProcess) setupHostname() error {
-	if err := unix.Sethostname([]byte(p.Container.Spec.Hostname)); err != nil {
-		return fmt.Errorf("failed to set hostname: %v", err)
+	// Switch to the process user
+	if err := p.setupUser(); err != nil {
+		return fmt.Errorf("failed to setup user: %w", err)
 	}
-	return nil
-}
 
-func (p *InitProcess) Chroot() error {
-	if err := unix.Chroot("/"); err != nil {
-		return fmt.Errorf("failed to chroot: %v", err)
+	// Setup capabilities
+	if p.Container.Spec.Process.Capabilities != nil {
+		if err := p.setupCapabilities(); err != nil {
+			return fmt.Errorf("failed to setup capabilities: %w", err)
+		}
 	}
+
 	return nil
 }
 
-// CreateProcess creates a new process but doesn't start it
-func (p *InitProcess) CreateProcess() error {
-	if p.Container.Spec.Process == nil {
+// ExecProcess replaces the init with the container process
+func (p *InitProcess) ExecProcess() error {
+	if p.Container.Spec.Process == nil || len(p.Container.Process.Args) == 0 {
 		return fmt.Errorf("no process specified in container spec")
 	}
 
-	if err := p.Chroot(); err != nil {
-		return fmt.Errorf("failed to chroot: %v", err)
+	cwd := p.Container.Spec.Process.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	if err := unix.Chdir(cwd); err != nil {
+		return fmt.Errorf("failed to chdir to %s: %w", cwd, os.NewSyscallError("chdir", err))
 	}
 
-	if err := p.setupHostname(); err != nil {
-		return fmt.Errorf("failed to setup hostname: %v", err)
+	env := p.Container.Process.Env
+	path, err := lookPath(p.Container.Process.Args[0], env)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.Command(p.Container.Spec.Process.Args[0], p.Container.Spec.Process.Args[1:]...)
+	if err := p.waitForStart(); err != nil {
+		return err
+	}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if p.Container.Spec.Process.NoNewPrivileges {
+		if err := setNoNewPrivileges(); err != nil {
+			return err
+		}
+	}
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start process: %v", err)
+	// Tell start the container process is about to be executed, before the
+	// seccomp filter can forbid it. The fifo closes on exec.
+	if _, err := p.execFifo.Write([]byte{0}); err != nil {
+		return fmt.Errorf("failed to write exec fifo: %w", err)
 	}
 
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			fmt.Printf("process exited with error: %v", err)
+	// Load seccomp as the last step so the filter does not apply to the setup
+	if p.seccomp != nil {
+		if err := p.loadSeccomp(); err != nil {
+			return err
 		}
-	}()
+	}
 
+	if err := unix.Exec(path, p.Container.Process.Args, env); err != nil {
+		return fmt.Errorf("failed to exec %s: %w", path, os.NewSyscallError("execve", err))
+	}
 	return nil
 }
 
+// lookPath resolves name against the PATH of env inside the container root
+func lookPath(name string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		if err := isExecutable(name); err != nil {
+			return "", fmt.Errorf("executable %s not found in container: %w", name, err)
+		}
+		return name, nil
+	}
+
+	pathEnv := defaultPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			pathEnv = strings.TrimPrefix(kv, "PATH=")
+		}
+	}
+
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, name)
+		if isExecutable(path) == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("executable %s not found in container $PATH %s", name, pathEnv)
+}
+
+// isExecutable checks that path is a regular file we may execute
+func isExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return unix.Access(path, unix.X_OK)
+}
+
 // StartProcess starts the created process
 func (p *InitProcess) StartProcess() error {
 	if err := syscall.Kill(p.Container.Process.ID, syscall.SIGCONT); err != nil {
-		return fmt.Errorf("failed to send SIGCONT: %v", err)
+		return fmt.Errorf("failed to send SIGCONT: %w", os.NewSyscallError("kill", err))
 	}
 
 	return nil
@@ -0,0 +1,310 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// namespaceFlags maps OCI namespace types to clone flags
+var namespaceFlags = map[specs.LinuxNamespaceType]uintptr{
+	specs.PIDNamespace:     unix.CLONE_NEWPID,
+	specs.NetworkNamespace: unix.CLONE_NEWNET,
+	specs.MountNamespace:   unix.CLONE_NEWNS,
+	specs.UTSNamespace:     unix.CLONE_NEWUTS,
+	specs.IPCNamespace:     unix.CLONE_NEWIPC,
+	specs.UserNamespace:    unix.CLONE_NEWUSER,
+	specs.CgroupNamespace:  unix.CLONE_NEWCGROUP,
+	specs.TimeNamespace:    unix.CLONE_NEWTIME,
+}
+
+// unshareFlags are the namespaces the init process unshares itself: the
+// cgroup namespace once it is in its cgroup, and the time namespace once the
+// clock offsets are known
+const unshareFlags = unix.CLONE_NEWCGROUP | unix.CLONE_NEWTIME
+
+// timeOffsetClocks are the clocks a time namespace can offset
+var timeOffsetClocks = map[string]bool{
+	"monotonic": true,
+	"boottime":  true,
+}
+
+// namespaceJoin is an existing namespace the init process joins
+type namespaceJoin struct {
+	flag uintptr
+	path string
+}
+
+// namespaces splits the spec namespaces into clone flags for the namespaces to
+// create and the existing namespaces to join. Joins are ordered so the user
+// namespace comes first, which grants the privileges to join the others, and
+// the mount namespace comes last, since it changes how later paths resolve.
+func (p *InitProcess) namespaces() (uintptr, []namespaceJoin, error) {
+	var cloneFlags uintptr
+	var joins []namespaceJoin
+	if p.Container.Spec.Linux == nil {
+		return 0, nil, nil
+	}
+
+	for _, ns := range p.Container.Spec.Linux.Namespaces {
+		flag, ok := namespaceFlags[ns.Type]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown namespace type %q", ns.Type)
+		}
+		if ns.Path == "" {
+			if flag&unshareFlags == 0 {
+				cloneFlags |= flag
+			}
+			continue
+		}
+		if err := validateNamespacePath(ns.Path, flag); err != nil {
+			return 0, nil, fmt.Errorf("invalid %s namespace: %w", ns.Type, err)
+		}
+		joins = append(joins, namespaceJoin{flag: flag, path: ns.Path})
+	}
+
+	ordered := make([]namespaceJoin, 0, len(joins))
+	for _, join := range joins {
+		if join.flag == unix.CLONE_NEWUSER {
+			ordered = append(ordered, join)
+		}
+	}
+	for _, join := range joins {
+		if join.flag != unix.CLONE_NEWUSER && join.flag != unix.CLONE_NEWNS {
+			ordered = append(ordered, join)
+		}
+	}
+	for _, join := range joins {
+		if join.flag == unix.CLONE_NEWNS {
+			ordered = append(ordered, join)
+		}
+	}
+	return cloneFlags, ordered, nil
+}
+
+// ownsNamespace reports whether the spec creates a new namespace of nsType
+func ownsNamespace(spec *specs.Spec, nsType specs.LinuxNamespaceType) bool {
+	if spec.Linux == nil {
+		return false
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == nsType && ns.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNamespaces checks the namespace types and that time offsets come
+// with a time namespace of our own
+func validateNamespaces(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		return nil
+	}
+
+	seen := make(map[specs.LinuxNamespaceType]bool)
+	ownsTime := false
+	for _, ns := range spec.Linux.Namespaces {
+		if _, ok := namespaceFlags[ns.Type]; !ok {
+			return fmt.Errorf("unknown namespace type %q", ns.Type)
+		}
+		if seen[ns.Type] {
+			return fmt.Errorf("duplicate %s namespace", ns.Type)
+		}
+		seen[ns.Type] = true
+		if ns.Type == specs.TimeNamespace && ns.Path == "" {
+			ownsTime = true
+		}
+	}
+
+	if len(spec.Linux.TimeOffsets) > 0 && !ownsTime {
+		return fmt.Errorf("timeOffsets require a new time namespace")
+	}
+	for clock := range spec.Linux.TimeOffsets {
+		if !timeOffsetClocks[clock] {
+			return fmt.Errorf("unknown time offset clock %q", clock)
+		}
+	}
+	return nil
+}
+
+// SetupNamespaces waits until the runtime placed the init in its cgroup and
+// mapped its user, and then creates the cgroup and time namespaces
+func (p *InitProcess) SetupNamespaces() error {
+	// A re-executed init has been resumed already
+	if os.Getenv("_SIMCON_REEXEC") != "done" {
+		if err := readSync(p.sync, syncResume); err != nil {
+			return err
+		}
+	}
+	if err := reexecIfMapped(); err != nil {
+		return err
+	}
+
+	// Keep the runtime's descriptors from leaking into the container process
+	unix.CloseOnExec(int(p.sync.Fd()))
+	var err error
+	if p.execFifo, err = inheritedFile("_SIMCON_FIFOFD"); err != nil {
+		return err
+	}
+	unix.CloseOnExec(int(p.execFifo.Fd()))
+
+	// /proc still belongs to the host PID namespace, so this is the PID the
+	// runtime and hooks see
+	if p.hostPID, err = readHostPID(); err != nil {
+		return err
+	}
+	p.Container.Process.ID = p.hostPID
+
+	var flags uintptr
+	if p.Container.Spec.Linux != nil {
+		for _, ns := range p.Container.Spec.Linux.Namespaces {
+			if flag := namespaceFlags[ns.Type]; flag&unshareFlags != 0 && ns.Path == "" {
+				flags |= flag
+			}
+		}
+	}
+	if flags == 0 {
+		return nil
+	}
+
+	if err := unix.Unshare(int(flags)); err != nil {
+		return fmt.Errorf("failed to unshare namespaces: %w", os.NewSyscallError("unshare", err))
+	}
+
+	// The new time namespace applies from the exec of the container process,
+	// its offsets can only be written until then
+	if flags&unix.CLONE_NEWTIME != 0 {
+		if err := setTimeOffsets(p.Container.Spec.Linux.TimeOffsets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inheritedFile opens a descriptor the runtime passed to the init
+func inheritedFile(env string) (*os.File, error) {
+	fd, err := strconv.Atoi(os.Getenv(env))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", env, err)
+	}
+	return os.NewFile(uintptr(fd), env), nil
+}
+
+// readHostPID reads our PID from /proc before it is replaced by the
+// container's
+func readHostPID() (int, error) {
+	self, err := os.Readlink("/proc/self")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read host pid: %w", err)
+	}
+	pid, err := strconv.Atoi(self)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse host pid %q: %w", self, err)
+	}
+	return pid, nil
+}
+
+// setTimeOffsets writes the clock offsets of the new time namespace, which
+// must have been unshared by the main thread
+func setTimeOffsets(offsets map[string]specs.LinuxTimeOffset) error {
+	var data strings.Builder
+	for clock, offset := range offsets {
+		fmt.Fprintf(&data, "%s %d %d\n", clock, offset.Secs, offset.Nanosecs)
+	}
+	if data.Len() == 0 {
+		return nil
+	}
+
+	// The kernel only has timens_offsets for a whole process, where it
+	// offsets the time namespace the main thread created for its children
+	if unix.Gettid() != os.Getpid() {
+		return fmt.Errorf("failed to set time offsets: the time namespace was not created by the main thread")
+	}
+	if err := os.WriteFile("/proc/self/timens_offsets", []byte(data.String()), 0644); err != nil {
+		return fmt.Errorf("failed to set time offsets: %w", err)
+	}
+	return nil
+}
+
+// validateNamespacePath checks that path is a namespace of the type of flag
+func validateNamespacePath(path string, flag uintptr) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, os.NewSyscallError("open", err))
+	}
+	defer unix.Close(fd)
+
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, os.NewSyscallError("fstatfs", err))
+	}
+	if st.Type != unix.NSFS_MAGIC {
+		return fmt.Errorf("%s is not a namespace", path)
+	}
+
+	nsType, err := unix.IoctlRetInt(fd, unix.NS_GET_NSTYPE)
+	if err != nil {
+		return fmt.Errorf("failed to get the type of %s: %w", path, os.NewSyscallError("ioctl", err))
+	}
+	if uintptr(nsType) != flag {
+		return fmt.Errorf("%s is a namespace of another type", path)
+	}
+	return nil
+}
+
+// nsenterEnv encodes the namespaces to join for pkg/nsenter
+func nsenterEnv(joins []namespaceJoin) string {
+	entries := make([]string, len(joins))
+	for i, join := range joins {
+		entries[i] = fmt.Sprintf("%d:%s", join.flag, join.path)
+	}
+	return strings.Join(entries, ",")
+}
+
+// syncNsenter serves pkg/nsenter until it is done with the namespaces of the
+// init: it maps the user namespace nsenter created on request and takes the
+// PID of the init when nsenter forked it
+func (p *InitProcess) syncNsenter(sync *os.File) error {
+	r := bufio.NewReader(sync)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read from nsenter: %w", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "idmap" {
+			if err := mapUserNamespace(p.cmd.Process.Pid, p.Container.Spec); err != nil {
+				return err
+			}
+			if _, err := sync.Write([]byte{0}); err != nil {
+				return fmt.Errorf("failed to resume nsenter: %w", err)
+			}
+			continue
+		}
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("unexpected message from nsenter %q", line)
+		}
+		p.Container.Process.ID = pid
+	}
+}
+
+// checkNamespacesJoined fails when the init was started with namespaces to
+// join but pkg/nsenter did not join them
+func checkNamespacesJoined() error {
+	if os.Getenv("_SIMCON_NSPATHS") != "" {
+		return fmt.Errorf("namespace paths are not supported: simcon was built without cgo")
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Values for ioprio_set(2)
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// ioPriorityClasses maps OCI I/O priority classes to kernel values
+var ioPriorityClasses = map[specs.IOPriorityClass]int{
+	specs.IOPRIO_CLASS_RT:   1,
+	specs.IOPRIO_CLASS_BE:   2,
+	specs.IOPRIO_CLASS_IDLE: 3,
+}
+
+// personalityDomains maps OCI personality domains to kernel values
+var personalityDomains = map[specs.LinuxPersonalityDomain]uintptr{
+	specs.PerLinux:   0x0000,
+	specs.PerLinux32: 0x0008,
+}
+
+// personalityFlags maps personality flag names to kernel values
+var personalityFlags = map[specs.LinuxPersonalityFlag]uintptr{
+	"UNAME26":            0x0020000,
+	"ADDR_NO_RANDOMIZE":  0x0040000,
+	"FDPIC_FUNCPTRS":     0x0080000,
+	"MMAP_PAGE_ZERO":     0x0100000,
+	"ADDR_COMPAT_LAYOUT": 0x0200000,
+	"READ_IMPLIES_EXEC":  0x0400000,
+	"ADDR_LIMIT_32BIT":   0x0800000,
+	"SHORT_INODE":        0x1000000,
+	"WHOLE_SECONDS":      0x2000000,
+	"STICKY_TIMEOUTS":    0x4000000,
+	"ADDR_LIMIT_3GB":     0x8000000,
+}
+
+// schedulerPolicies maps OCI scheduler policies to kernel values
+var schedulerPolicies = map[specs.LinuxSchedulerPolicy]uint32{
+	specs.SchedOther:    unix.SCHED_NORMAL,
+	specs.SchedFIFO:     unix.SCHED_FIFO,
+	specs.SchedRR:       unix.SCHED_RR,
+	specs.SchedBatch:    unix.SCHED_BATCH,
+	specs.SchedISO:      4,
+	specs.SchedIdle:     unix.SCHED_IDLE,
+	specs.SchedDeadline: unix.SCHED_DEADLINE,
+}
+
+// schedulerFlags maps OCI scheduler flags to kernel values
+var schedulerFlags = map[specs.LinuxSchedulerFlag]uint64{
+	specs.SchedFlagResetOnFork:  unix.SCHED_FLAG_RESET_ON_FORK,
+	specs.SchedFlagReclaim:      unix.SCHED_FLAG_RECLAIM,
+	specs.SchedFlagDLOverrun:    unix.SCHED_FLAG_DL_OVERRUN,
+	specs.SchedFlagKeepPolicy:   unix.SCHED_FLAG_KEEP_POLICY,
+	specs.SchedFlagKeepParams:   unix.SCHED_FLAG_KEEP_PARAMS,
+	specs.SchedFlagUtilClampMin: unix.SCHED_FLAG_UTIL_CLAMP_MIN,
+	specs.SchedFlagUtilClampMax: unix.SCHED_FLAG_UTIL_CLAMP_MAX,
+}
+
+// setupProcessAttributes applies the process attributes that need privileges,
+// so it runs before the user switch
+func (p *InitProcess) setupProcessAttributes() error {
+	process := p.Container.Spec.Process
+
+	if process.OOMScoreAdj != nil {
+		if err := setOOMScoreAdj(*process.OOMScoreAdj); err != nil {
+			return err
+		}
+	}
+
+	if p.Container.Spec.Linux != nil && p.Container.Spec.Linux.Personality != nil {
+		if err := setPersonality(p.Container.Spec.Linux.Personality); err != nil {
+			return err
+		}
+	}
+
+	if process.IOPriority != nil {
+		if err := setIOPriority(process.IOPriority); err != nil {
+			return err
+		}
+	}
+
+	if process.Scheduler != nil {
+		if err := setScheduler(process.Scheduler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOOMScoreAdj writes the OOM score adjustment of the init process
+func setOOMScoreAdj(score int) error {
+	if err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(score)), 0644); err != nil {
+		return fmt.Errorf("failed to set oom_score_adj: %w", err)
+	}
+	return nil
+}
+
+// setPersonality sets the execution domain and personality flags
+func setPersonality(personality *specs.LinuxPersonality) error {
+	persona, ok := personalityDomains[personality.Domain]
+	if !ok {
+		return fmt.Errorf("unknown personality domain %q", personality.Domain)
+	}
+	for _, f := range personality.Flags {
+		flag, ok := personalityFlags[f]
+		if !ok {
+			return fmt.Errorf("unknown personality flag %q", f)
+		}
+		persona |= flag
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_PERSONALITY, persona, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to set personality: %w", os.NewSyscallError("personality", errno))
+	}
+	return nil
+}
+
+// setIOPriority sets the I/O scheduling class and priority
+func setIOPriority(priority *specs.LinuxIOPriority) error {
+	class, ok := ioPriorityClasses[priority.Class]
+	if !ok {
+		return fmt.Errorf("unknown I/O priority class %q", priority.Class)
+	}
+	if priority.Priority < 0 || priority.Priority > 7 {
+		return fmt.Errorf("I/O priority %d out of range 0-7", priority.Priority)
+	}
+
+	ioprio := uintptr(class<<ioprioClassShift | priority.Priority)
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprio); errno != 0 {
+		return fmt.Errorf("failed to set I/O priority: %w", os.NewSyscallError("ioprio_set", errno))
+	}
+	return nil
+}
+
+// setScheduler sets the scheduling policy and attributes
+func setScheduler(scheduler *specs.Scheduler) error {
+	policy, ok := schedulerPolicies[scheduler.Policy]
+	if !ok {
+		return fmt.Errorf("unknown scheduler policy %q", scheduler.Policy)
+	}
+
+	attr := unix.SchedAttr{
+		Policy:   policy,
+		Nice:     scheduler.Nice,
+		Priority: uint32(scheduler.Priority),
+		Runtime:  scheduler.Runtime,
+		Deadline: scheduler.Deadline,
+		Period:   scheduler.Period,
+	}
+	for _, f := range scheduler.Flags {
+		flag, ok := schedulerFlags[f]
+		if !ok {
+			return fmt.Errorf("unknown scheduler flag %q", f)
+		}
+		attr.Flags |= flag
+	}
+
+	if err := unix.SchedSetAttr(0, &attr, 0); err != nil {
+		return fmt.Errorf("failed to set scheduler: %w", os.NewSyscallError("sched_setattr", err))
+	}
+	return nil
+}
+
+// setNoNewPrivileges prevents the container process from gaining privileges on exec
+func setNoNewPrivileges() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", os.NewSyscallError("prctl", err))
+	}
+	return nil
+}
+
+// procStatFields returns the fields of /proc/<pid>/stat after the command,
+// starting with the state, which is field 3 of the whole line
+func procStatFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command in parentheses may contain spaces, the fields follow it
+	stat := string(data)
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	return fields, nil
+}
+
+// readProcStat returns the state and start time of pid from /proc/<pid>/stat
+func readProcStat(pid int) (byte, uint64, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The start time is field 22 of the whole line
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed start time of pid %d: %w", pid, err)
+	}
+	return fields[0][0], startTime, nil
+}
+
+// killChild kills pid if it is still a child of parent. A pidfd pins the
+// process while its parent is checked, so a process that reused the PID is
+// left alone.
+func killChild(pid, parent int) error {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if errors.Is(err, unix.ESRCH) {
+		return nil
+	}
+	if err != nil {
+		return os.NewSyscallError("pidfd_open", err)
+	}
+	defer unix.Close(pidfd)
+
+	fields, err := procStatFields(pid)
+	if err != nil || fields[1] != strconv.Itoa(parent) {
+		return nil
+	}
+	if err := unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0); err != nil && !errors.Is(err, unix.ESRCH) {
+		return os.NewSyscallError("pidfd_send_signal", err)
+	}
+	return nil
+}
+
+// processStartTime returns the start time of pid in clock ticks after boot
+func processStartTime(pid int) (uint64, error) {
+	_, startTime, err := readProcStat(pid)
+	return startTime, err
+}
+
+// isProcess reports whether pid is alive and still the process that started
+// at startTime rather than a later one reusing its PID
+func isProcess(pid int, startTime uint64) bool {
+	state, st, err := readProcStat(pid)
+	return err == nil && state != 'Z' && state != 'X' && st == startTime
+}
+
+// processExited reports whether pid has exited, reaped or not
+func processExited(pid int) bool {
+	state, _, err := readProcStat(pid)
+	return err != nil || state == 'Z' || state == 'X'
+}
+
+// signalProcess sends sig to pid if it is still the process that started at
+// startTime. A pidfd pins the process while its identity is checked, so the
+// signal cannot reach a process that reused the PID in between.
+func signalProcess(pid int, startTime uint64, sig unix.Signal) error {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if errors.Is(err, unix.ENOSYS) {
+		// Kernels before 5.3 have no pidfds, which leaves a small window
+		if !isProcess(pid, startTime) {
+			return ErrNotRunning
+		}
+		return os.NewSyscallError("kill", unix.Kill(pid, sig))
+	}
+	if errors.Is(err, unix.ESRCH) {
+		return ErrNotRunning
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open pidfd: %w", os.NewSyscallError("pidfd_open", err))
+	}
+	defer unix.Close(pidfd)
+
+	if !isProcess(pid, startTime) {
+		return ErrNotRunning
+	}
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return ErrNotRunning
+		}
+		return os.NewSyscallError("pidfd_send_signal", err)
+	}
+	return nil
+}
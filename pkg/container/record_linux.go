@@ -0,0 +1,125 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/yoonhyunwoo/simcon/pkg/cgroups"
+	"github.com/yoonhyunwoo/simcon/pkg/filesystem"
+)
+
+// Besides its state, the runtime keeps a record of the paths it owns for a
+// container below the runtime root. The state usually lives on tmpfs, the
+// record survives a reboot, so what a container left behind can still be
+// found when its state is lost.
+
+// recordFile is the name of the record in the record directory of a container
+const recordFile = "record.json"
+
+// containerRecord lists the paths the runtime owns for a container
+type containerRecord struct {
+	ID         string `json:"id"`
+	CgroupPath string `json:"cgroupPath,omitempty"`
+}
+
+// instanceName names what a runtime instance keeps outside its state
+// directory: its directory below the runtime root and its cgroup parent.
+// Instances are told apart by their state directory.
+func (m *StateManager) instanceName() string {
+	sum := sha256.Sum256([]byte(m.RootDir))
+	return "simcon-" + hex.EncodeToString(sum[:6])
+}
+
+// recordDir returns the record directory of the container id
+func (m *StateManager) recordDir(id string) (string, error) {
+	if err := validateID(id); err != nil {
+		return "", err
+	}
+	return joinInRoot(filepath.Join(filesystem.RootDir, m.instanceName()), id)
+}
+
+// saveRecord writes the record of a container, before the paths it lists
+// are created
+func (m *StateManager) saveRecord(record *containerRecord) error {
+	dir, err := m.recordDir(record.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create record directory: %w", err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, recordFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	return nil
+}
+
+// removeRecorded removes the cgroup of the container id and then its record,
+// so a failure leaves the record to retry with
+func (m *StateManager) removeRecorded(id, cgroupPath string) error {
+	if cgroupPath != "" {
+		if err := (&cgroups.CgroupManager{Path: cgroupPath}).Remove(); err != nil {
+			return fmt.Errorf("failed to remove cgroup: %w", err)
+		}
+	}
+
+	dir, err := m.recordDir(id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove record: %w", err)
+	}
+	return nil
+}
+
+// readRecord reads the record of the container id
+func (m *StateManager) readRecord(id string) (*containerRecord, error) {
+	dir, err := m.recordDir(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, recordFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+
+	var record containerRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse record: %w", err)
+	}
+	// Only ever remove a cgroup this instance would have created for id
+	if record.ID != id || record.CgroupPath != "" &&
+		(filepath.Base(record.CgroupPath) != id || filepath.Base(filepath.Dir(record.CgroupPath)) != m.instanceName()) {
+		return nil, fmt.Errorf("record does not belong to container %s", id)
+	}
+	return &record, nil
+}
+
+// recordedIDs returns the IDs of the containers this instance has records of
+func (m *StateManager) recordedIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(filesystem.RootDir, m.instanceName()))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && validateID(entry.Name()) == nil {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,73 @@
+package container
+
+import (
+	"fmt"
+	"os"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// rlimitTypes maps OCI rlimit type names to resources
+var rlimitTypes = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// parseRlimit validates an rlimit and returns its resource
+func parseRlimit(rlimit specs.POSIXRlimit) (int, error) {
+	resource, ok := rlimitTypes[rlimit.Type]
+	if !ok {
+		return 0, fmt.Errorf("unknown rlimit type %q", rlimit.Type)
+	}
+	if rlimit.Soft > rlimit.Hard {
+		return 0, fmt.Errorf("soft limit %d of %s exceeds hard limit %d", rlimit.Soft, rlimit.Type, rlimit.Hard)
+	}
+	return resource, nil
+}
+
+// validateRlimits checks every rlimit in the spec
+func validateRlimits(rlimits []specs.POSIXRlimit) error {
+	seen := make(map[string]bool)
+	for _, rlimit := range rlimits {
+		if _, err := parseRlimit(rlimit); err != nil {
+			return err
+		}
+		if seen[rlimit.Type] {
+			return fmt.Errorf("duplicate rlimit type %s", rlimit.Type)
+		}
+		seen[rlimit.Type] = true
+	}
+	return nil
+}
+
+// setupRlimits applies the rlimits to the init process. It runs before the
+// user switch so hard limits can still be raised.
+func (p *InitProcess) setupRlimits() error {
+	for _, rlimit := range p.Container.Spec.Process.Rlimits {
+		resource, err := parseRlimit(rlimit)
+		if err != nil {
+			return err
+		}
+
+		limit := unix.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}
+		if err := unix.Prlimit(0, resource, &limit, nil); err != nil {
+			return fmt.Errorf("failed to set %s: %w", rlimit.Type, os.NewSyscallError("prlimit", err))
+		}
+	}
+	return nil
+}
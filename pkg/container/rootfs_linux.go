@@ -0,0 +1,405 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// mountPropagationFlags maps propagation names to mount flags
+var mountPropagationFlags = map[string]uintptr{
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"shared":      unix.MS_SHARED,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
+// mountOption describes how a mount option affects the mount flags
+type mountOption struct {
+	clear bool
+	flag  uintptr
+}
+
+// mountOptions maps mount option names to mount flags
+var mountOptions = map[string]mountOption{
+	"async":         {true, unix.MS_SYNCHRONOUS},
+	"atime":         {true, unix.MS_NOATIME},
+	"bind":          {false, unix.MS_BIND},
+	"defaults":      {false, 0},
+	"dev":           {true, unix.MS_NODEV},
+	"diratime":      {true, unix.MS_NODIRATIME},
+	"dirsync":       {false, unix.MS_DIRSYNC},
+	"exec":          {true, unix.MS_NOEXEC},
+	"mand":          {false, unix.MS_MANDLOCK},
+	"noatime":       {false, unix.MS_NOATIME},
+	"nodev":         {false, unix.MS_NODEV},
+	"nodiratime":    {false, unix.MS_NODIRATIME},
+	"noexec":        {false, unix.MS_NOEXEC},
+	"nomand":        {true, unix.MS_MANDLOCK},
+	"norelatime":    {true, unix.MS_RELATIME},
+	"nostrictatime": {true, unix.MS_STRICTATIME},
+	"nosuid":        {false, unix.MS_NOSUID},
+	"rbind":         {false, unix.MS_BIND | unix.MS_REC},
+	"relatime":      {false, unix.MS_RELATIME},
+	"remount":       {false, unix.MS_REMOUNT},
+	"ro":            {false, unix.MS_RDONLY},
+	"rw":            {true, unix.MS_RDONLY},
+	"strictatime":   {false, unix.MS_STRICTATIME},
+	"suid":          {true, unix.MS_NOSUID},
+	"sync":          {false, unix.MS_SYNCHRONOUS},
+}
+
+// parseMountOptions splits mount options into flags, propagation flags and data
+func parseMountOptions(options []string) (uintptr, []uintptr, string) {
+	var (
+		flags       uintptr
+		propagation []uintptr
+		data        []string
+	)
+
+	for _, o := range options {
+		if opt, ok := mountOptions[o]; ok {
+			if opt.clear {
+				flags &^= opt.flag
+			} else {
+				flags |= opt.flag
+			}
+			continue
+		}
+		if f, ok := mountPropagationFlags[o]; ok {
+			propagation = append(propagation, f)
+			continue
+		}
+		data = append(data, o)
+	}
+
+	return flags, propagation, strings.Join(data, ",")
+}
+
+// rootfsPath returns the absolute path of the container root filesystem
+func (p *InitProcess) rootfsPath() (string, error) {
+	if p.Container.Spec.Root == nil || p.Container.Spec.Root.Path == "" {
+		return "", fmt.Errorf("no root specified in container spec")
+	}
+
+	rootfs := p.Container.Spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(p.Container.Bundle, rootfs)
+	}
+
+	rootfs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve rootfs path: %w", err)
+	}
+	return filepath.EvalSymlinks(rootfs)
+}
+
+// hasNamespace reports whether the spec requests a namespace of the given type
+func (p *InitProcess) hasNamespace(nsType specs.LinuxNamespaceType) bool {
+	if p.Container.Spec.Linux == nil {
+		return false
+	}
+	for _, ns := range p.Container.Spec.Linux.Namespaces {
+		if ns.Type == nsType {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMount reports whether the spec mounts something at the given destination
+func (p *InitProcess) hasMount(destination string) bool {
+	for _, m := range p.Container.Spec.Mounts {
+		if filepath.Clean(m.Destination) == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// setupRootPropagation sets the mount propagation of / before anything is mounted
+func (p *InitProcess) setupRootPropagation() error {
+	flags := uintptr(unix.MS_SLAVE | unix.MS_REC)
+	if p.Container.Spec.Linux != nil && p.Container.Spec.Linux.RootfsPropagation != "" {
+		f, ok := mountPropagationFlags[p.Container.Spec.Linux.RootfsPropagation]
+		if !ok {
+			return fmt.Errorf("unknown rootfs propagation %q", p.Container.Spec.Linux.RootfsPropagation)
+		}
+		flags = f
+	}
+
+	if err := unix.Mount("", "/", "", flags, ""); err != nil {
+		return fmt.Errorf("failed to set propagation of /: %w", os.NewSyscallError("mount", err))
+	}
+	return nil
+}
+
+// maxSymlinks bounds the symlinks followed while resolving a path in the rootfs
+const maxSymlinks = 255
+
+// resolveInRoot resolves path as if rootfs were the root directory, so that
+// symlinks in the image, absolute or through .., cannot lead out of it. The
+// part of path that does not exist yet is kept as is.
+func resolveInRoot(rootfs, path string) (string, error) {
+	resolved := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("failed to resolve %s: %w", path, unix.ELOOP)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+
+	full := filepath.Join(rootfs, resolved)
+	if rel, err := filepath.Rel(rootfs, full); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path %s escapes the container root", path)
+	}
+	return full, nil
+}
+
+// mountToRootfs mounts a spec mount below the container root filesystem.
+// Relative bind mount sources are relative to the bundle, devpts mounts
+// always get their own instance.
+func mountToRootfs(rootfs, bundle string, m specs.Mount) error {
+	dest, err := resolveInRoot(rootfs, m.Destination)
+	if err != nil {
+		return err
+	}
+	if m.Type == "devpts" {
+		m.Options = ptsOptions(m.Options)
+	}
+	flags, propagation, data := parseMountOptions(m.Options)
+
+	if flags&unix.MS_BIND != 0 {
+		if !filepath.IsAbs(m.Source) {
+			m.Source = filepath.Join(bundle, m.Source)
+		}
+		info, err := os.Stat(m.Source)
+		if err != nil {
+			return fmt.Errorf("failed to stat bind source: %w", err)
+		}
+		if err := createMountPoint(dest, info.IsDir()); err != nil {
+			return err
+		}
+	} else if err := createMountPoint(dest, true); err != nil {
+		return err
+	}
+
+	mountFlags := flags
+	if flags&unix.MS_BIND != 0 {
+		mountFlags = flags & (unix.MS_BIND | unix.MS_REC)
+	}
+	if err := unix.Mount(m.Source, dest, m.Type, mountFlags, data); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+
+	// Bind mounts ignore most flags on the first mount, so apply them with a remount
+	if flags&unix.MS_BIND != 0 && flags&^(unix.MS_BIND|unix.MS_REC) != 0 {
+		if err := unix.Mount("", dest, "", flags|unix.MS_REMOUNT|unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to remount bind mount: %w", os.NewSyscallError("mount", err))
+		}
+	}
+
+	for _, f := range propagation {
+		if err := unix.Mount("", dest, "", f, ""); err != nil {
+			return fmt.Errorf("failed to set propagation: %w", os.NewSyscallError("mount", err))
+		}
+	}
+	return nil
+}
+
+// createMountPoint creates a directory or an empty file to mount over
+func createMountPoint(path string, dir bool) error {
+	if dir {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("failed to create mount point: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	return f.Close()
+}
+
+// findMountPoint returns the mount point containing path
+func findMountPoint(path string) (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	mountPoint := "/"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mp := fields[4]
+		if (path == mp || strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/")) && len(mp) > len(mountPoint) {
+			mountPoint = mp
+		}
+	}
+	return mountPoint, scanner.Err()
+}
+
+// makeParentMountPrivate makes the mount containing path private so that
+// pivot_root accepts it and the rootfs bind mount does not propagate
+func makeParentMountPrivate(path string) error {
+	mountPoint, err := findMountPoint(path)
+	if err != nil {
+		return fmt.Errorf("failed to find mount point of %s: %w", path, err)
+	}
+	if err := unix.Mount("", mountPoint, "", unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make %s private: %w", mountPoint, os.NewSyscallError("mount", err))
+	}
+	return nil
+}
+
+// pivotRoot switches the root filesystem to rootfs and detaches the old root
+func pivotRoot(rootfs string) error {
+	oldRoot, err := unix.Open("/", unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open old root: %w", os.NewSyscallError("open", err))
+	}
+	defer unix.Close(oldRoot)
+
+	newRoot, err := unix.Open(rootfs, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open new root: %w", os.NewSyscallError("open", err))
+	}
+	defer unix.Close(newRoot)
+
+	if err := unix.Fchdir(newRoot); err != nil {
+		return fmt.Errorf("failed to chdir to new root: %w", os.NewSyscallError("fchdir", err))
+	}
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", os.NewSyscallError("pivot_root", err))
+	}
+
+	// The old root is now stacked on top of the new one; detach it
+	if err := unix.Fchdir(oldRoot); err != nil {
+		return fmt.Errorf("failed to chdir to old root: %w", os.NewSyscallError("fchdir", err))
+	}
+	if err := unix.Mount("", ".", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to make old root slave: %w", os.NewSyscallError("mount", err))
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount old root: %w", os.NewSyscallError("umount2", err))
+	}
+
+	return os.NewSyscallError("chdir", unix.Chdir("/"))
+}
+
+// statfsFlags maps the statfs(2) mount flags to their mount(2) flags
+var statfsFlags = map[int64]uintptr{
+	unix.ST_RDONLY:      unix.MS_RDONLY,
+	unix.ST_NOSUID:      unix.MS_NOSUID,
+	unix.ST_NODEV:       unix.MS_NODEV,
+	unix.ST_NOEXEC:      unix.MS_NOEXEC,
+	unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+	unix.ST_MANDLOCK:    unix.MS_MANDLOCK,
+	unix.ST_NOATIME:     unix.MS_NOATIME,
+	unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+	unix.ST_RELATIME:    unix.MS_RELATIME,
+}
+
+// remountReadonly remounts path read-only keeping its other mount flags
+func remountReadonly(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return fmt.Errorf("failed to statfs %s: %w", path, os.NewSyscallError("statfs", err))
+	}
+
+	// A bind remount must repeat the locked flags of the mount, see mount(2)
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for stFlag, msFlag := range statfsFlags {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	if err := unix.Mount("", path, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to remount %s read-only: %w", path, os.NewSyscallError("mount", err))
+	}
+	return nil
+}
+
+// maskPath hides path by binding /dev/null over files or mounting an empty
+// read-only tmpfs over directories; missing paths are ignored
+func maskPath(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	if info.IsDir() {
+		if err := unix.Mount("tmpfs", path, "tmpfs", unix.MS_RDONLY, "size=0"); err != nil {
+			return fmt.Errorf("failed to mask %s: %w", path, os.NewSyscallError("mount", err))
+		}
+		return nil
+	}
+
+	if err := unix.Mount("/dev/null", path, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mask %s: %w", path, os.NewSyscallError("mount", err))
+	}
+	return nil
+}
+
+// readonlyPath bind mounts path onto itself read-only; missing paths are ignored
+func readonlyPath(path string) error {
+	if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("failed to bind mount %s: %w", path, os.NewSyscallError("mount", err))
+	}
+	return remountReadonly(path)
+}
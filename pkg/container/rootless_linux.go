@@ -0,0 +1,111 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// rootless reports whether simcon runs without root privileges. The init runs
+// as root of its user namespace, so the runtime tells it through the
+// environment.
+func rootless() bool {
+	return os.Geteuid() != 0 || os.Getenv("_SIMCON_ROOTLESS") != ""
+}
+
+// configureRootless adjusts the spec for an unprivileged runtime: the
+// container always gets a user namespace, and /sys is bind mounted from the
+// host since sysfs can only be mounted by the owner of the network namespace.
+// On the host side the user namespace mappings default to the caller's ids
+// followed by its subordinate ranges.
+func configureRootless(spec *specs.Spec, host bool) error {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+
+	hasUser := false
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == specs.UserNamespace {
+			hasUser = true
+		}
+	}
+	if !hasUser {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+	}
+
+	for i, m := range spec.Mounts {
+		if m.Type == "sysfs" {
+			spec.Mounts[i] = specs.Mount{
+				Destination: m.Destination,
+				Type:        "bind",
+				Source:      "/sys",
+				Options:     append([]string{"rbind"}, m.Options...),
+			}
+		}
+	}
+
+	if !host || !ownsNamespace(spec, specs.UserNamespace) {
+		return nil
+	}
+
+	if len(spec.Linux.UIDMappings) == 0 {
+		mappings, err := rootlessMappings(os.Geteuid(), "/etc/subuid")
+		if err != nil {
+			return err
+		}
+		spec.Linux.UIDMappings = mappings
+	}
+	if len(spec.Linux.GIDMappings) == 0 {
+		mappings, err := rootlessMappings(os.Getegid(), "/etc/subgid")
+		if err != nil {
+			return err
+		}
+		spec.Linux.GIDMappings = mappings
+	}
+	return nil
+}
+
+// rootlessMappings maps root of the container to id and the following ids to
+// the caller's ranges in a subuid style file
+func rootlessMappings(id int, path string) ([]specs.LinuxIDMapping, error) {
+	mappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(id), Size: 1}}
+
+	names := map[string]bool{strconv.Itoa(os.Geteuid()): true}
+	if u, err := user.Current(); err == nil {
+		names[u.Username] = true
+	}
+
+	containerID := uint32(1)
+	err := readColonFile(path, func(fields []string) error {
+		if len(fields) != 3 || !names[fields[0]] {
+			return nil
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid start %q", fields[1])
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid count %q", fields[2])
+		}
+		mappings = append(mappings, specs.LinuxIDMapping{
+			ContainerID: containerID,
+			HostID:      uint32(start),
+			Size:        uint32(count),
+		})
+		containerID += uint32(count)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if len(mappings) == 1 {
+		logrus.Warnf("rootless: no ranges in %s, only root is mapped into the container", path)
+	}
+	return mappings, nil
+}
@@ -0,0 +1,79 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/yoonhyunwoo/simcon/pkg/seccomp"
+	"golang.org/x/sys/unix"
+)
+
+// setupSeccomp compiles the seccomp filter, it is loaded right before exec
+func (p *InitProcess) setupSeccomp() error {
+	filter, err := seccomp.Compile(p.Container.Spec.Linux.Seccomp)
+	if err != nil {
+		return err
+	}
+	p.seccomp = filter
+	return nil
+}
+
+// connectSeccompListener connects to the seccomp agent at listenerPath. It
+// must run before pivoting while the host filesystem is reachable.
+func (p *InitProcess) connectSeccompListener() error {
+	if p.Container.Spec.Linux == nil || p.Container.Spec.Linux.Seccomp == nil || p.Container.Spec.Linux.Seccomp.ListenerPath == "" {
+		return nil
+	}
+
+	path := p.Container.Spec.Linux.Seccomp.ListenerPath
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to seccomp listener %s: %w", path, err)
+	}
+
+	p.seccompListener = conn
+	return nil
+}
+
+// loadSeccomp loads the seccomp filter and sends the notify fd to the agent
+func (p *InitProcess) loadSeccomp() error {
+	fd, err := seccomp.Load(p.seccomp)
+	if err != nil {
+		return err
+	}
+	if fd < 0 {
+		return nil
+	}
+	defer unix.Close(fd)
+
+	if p.seccompListener == nil {
+		return fmt.Errorf("seccomp listener is not connected")
+	}
+	defer p.seccompListener.Close()
+
+	state := specs.ContainerProcessState{
+		Version:  specs.Version,
+		Fds:      []string{specs.SeccompFdName},
+		Pid:      p.hostPID,
+		Metadata: p.Container.Spec.Linux.Seccomp.ListenerMetadata,
+		State: specs.State{
+			Version:     specs.Version,
+			ID:          p.Container.ID,
+			Status:      specs.StateCreating,
+			Pid:         p.hostPID,
+			Bundle:      p.Container.Bundle,
+			Annotations: p.Container.Spec.Annotations,
+		},
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal container process state: %w", err)
+	}
+
+	if _, _, err := p.seccompListener.WriteMsgUnix(data, unix.UnixRights(fd), nil); err != nil {
+		return fmt.Errorf("failed to send seccomp fd: %w", err)
+	}
+	return nil
+}
@@ -2,14 +2,20 @@ package container
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
-// ContainerState represents the state of a container according to OCI spec
+// ContainerState represents the state of a container according to OCI spec,
+// along with what the runtime needs to find the container again
 type ContainerState struct {
 	Version     string            `json:"ociVersion"`
 	ID          string            `json:"id"`
@@ -17,6 +23,18 @@ type ContainerState struct {
 	PID         int               `json:"pid,omitempty"`
 	Bundle      string            `json:"bundle"`
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Created is when the container was created
+	Created time.Time `json:"created"`
+	// InitStartTime is the start time of the init process in clock ticks
+	// after boot, which tells it apart from a process reusing its PID
+	InitStartTime uint64 `json:"initStartTime,omitempty"`
+	// CgroupPath is the cgroup of the container, if it has one
+	CgroupPath string `json:"cgroupPath,omitempty"`
+	// Rootfs is the resolved root filesystem of the container
+	Rootfs string `json:"rootfs,omitempty"`
+	// Owner is the UID that created the container
+	Owner int `json:"owner"`
 }
 
 // Valid container states
@@ -27,6 +45,25 @@ const (
 	StateStopped  = "stopped"
 )
 
+// OCIState returns the state of the container as defined by the runtime spec
+func (c *Container) OCIState() specs.State {
+	state := specs.State{
+		Version:     specs.Version,
+		ID:          c.ID,
+		Status:      specs.ContainerState(c.State.Status),
+		Bundle:      c.Bundle,
+		Annotations: c.Spec.Annotations,
+	}
+	if c.Process.ID > 0 && c.State.Status != StateStopped {
+		state.Pid = c.Process.ID
+	}
+	return state
+}
+
+// StateDir is where container state is kept. When empty, the default
+// directory for the user is used.
+var StateDir string
+
 // StateManager handles container state operations
 type StateManager struct {
 	RootDir string
@@ -34,26 +71,118 @@ type StateManager struct {
 
 // NewStateManager creates a new state manager
 func NewStateManager() *StateManager {
+	rootDir := StateDir
+	if rootDir == "" {
+		rootDir = defaultStateDir()
+	}
 	return &StateManager{
-		RootDir: "/run/simcon",
+		RootDir: rootDir,
+	}
+}
+
+// defaultStateDir returns where state is kept, which for an unprivileged
+// user is its runtime directory
+func defaultStateDir() string {
+	if !rootless() {
+		return "/run/simcon"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "simcon")
 	}
+	return filepath.Join("/run/user", strconv.Itoa(os.Geteuid()), "simcon")
 }
 
-// CreateState creates a new container state
-func (m *StateManager) CreateState(id, bundle string) (*ContainerState, error) {
+// maxIDLength bounds container IDs, which name directories
+const maxIDLength = 255
+
+// validateID checks that id is safe to use as a file and cgroup name
+func validateID(id string) error {
+	if id == "" {
+		return fmt.Errorf("container ID must not be empty")
+	}
+	if len(id) > maxIDLength {
+		return fmt.Errorf("container ID must be at most %d characters", maxIDLength)
+	}
+	for i, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case i > 0 && (r == '_' || r == '-' || r == '.' || r == '+'):
+		default:
+			return fmt.Errorf("invalid container ID %q: only letters, digits and _-.+ are allowed, starting with a letter or digit", id)
+		}
+	}
+	return nil
+}
+
+// dir returns the state directory of the container id
+func (m *StateManager) dir(id string) (string, error) {
+	if err := validateID(id); err != nil {
+		return "", err
+	}
+	return joinInRoot(m.RootDir, id)
+}
+
+// path returns the path of the file name in the state directory of id
+func (m *StateManager) path(id, name string) (string, error) {
+	dir, err := m.dir(id)
+	if err != nil {
+		return "", err
+	}
+	return joinInRoot(dir, name)
+}
+
+// joinInRoot joins name to root and checks the result stays inside root
+func joinInRoot(root, name string) (string, error) {
+	path := filepath.Join(root, name)
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path %s escapes %s", name, root)
+	}
+	return path, nil
+}
+
+// CreateState creates a new container state and returns it locked. The state
+// directory is created exclusively, so an ID in use fails with ErrExist, and
+// the state is only written once the lock is held, so whoever locks a state
+// without a creator finds either no state yet or one left by a creator that
+// died.
+func (m *StateManager) CreateState(id, bundle string) (*ContainerState, *StateLock, error) {
+	dir, err := m.dir(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(m.RootDir, 0711); err != nil {
+		return nil, nil, fmt.Errorf("failed to create state root: %w", err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, nil, fmt.Errorf("container %s: %w", id, ErrExist)
+		}
+		return nil, nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	lock, err := m.lock(id, unix.LOCK_EX)
+	if err != nil {
+		os.Remove(dir)
+		return nil, nil, err
+	}
+
 	state := &ContainerState{
 		Version:     specs.Version,
 		ID:          id,
 		Status:      StateCreating,
 		Bundle:      bundle,
 		Annotations: make(map[string]string),
+		Created:     time.Now().UTC(),
+		Owner:       os.Geteuid(),
 	}
 
 	if err := m.saveState(state); err != nil {
-		return nil, err
+		lock.Unlock()
+		os.RemoveAll(dir)
+		return nil, nil, err
 	}
 
-	return state, nil
+	return state, lock, nil
 }
 
 // UpdateState updates the container state
@@ -63,42 +192,178 @@ func (m *StateManager) UpdateState(state *ContainerState) error {
 
 // GetState retrieves the container state
 func (m *StateManager) GetState(id string) (*ContainerState, error) {
-	statePath := filepath.Join(m.RootDir, id, "state.json")
+	statePath, err := m.path(id, "state.json")
+	if err != nil {
+		return nil, err
+	}
 	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("container %s: %w", id, ErrNotExist)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read state file: %v", err)
+		return nil, fmt.Errorf("failed to read state file: %w", err)
 	}
 
 	var state ContainerState
 	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, fmt.Errorf("failed to parse state file: %v", err)
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
 	}
 
 	return &state, nil
 }
 
+// execFifoPath returns the path of the fifo the init waits on until start
+func (m *StateManager) execFifoPath(id string) (string, error) {
+	return m.path(id, "exec.fifo")
+}
+
+// hooksPath returns the path of the hooks merged at create time
+func (m *StateManager) hooksPath(id string) (string, error) {
+	return m.path(id, "hooks.json")
+}
+
+// saveHooks persists the hooks of a container so later operations and the
+// init process run the hooks merged at create time
+func (m *StateManager) saveHooks(id string, hooks *specs.Hooks) error {
+	data, err := json.Marshal(hooks)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hooks: %w", err)
+	}
+	path, err := m.hooksPath(id)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write hooks file: %w", err)
+	}
+	return nil
+}
+
+// readHooks reads hooks persisted by saveHooks
+func readHooks(path string) (*specs.Hooks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hooks file: %w", err)
+	}
+	var hooks specs.Hooks
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to parse hooks file: %w", err)
+	}
+	return &hooks, nil
+}
+
 // DeleteState removes the container state
 func (m *StateManager) DeleteState(id string) error {
-	stateDir := filepath.Join(m.RootDir, id)
+	stateDir, err := m.dir(id)
+	if err != nil {
+		return err
+	}
 	return os.RemoveAll(stateDir)
 }
 
 // saveState saves the container state to disk
 func (m *StateManager) saveState(state *ContainerState) error {
-	stateDir := filepath.Join(m.RootDir, state.ID)
-	if err := os.MkdirAll(stateDir, 0755); err != nil {
-		return fmt.Errorf("failed to create state directory: %v", err)
+	statePath, err := m.path(state.ID, "state.json")
+	if err != nil {
+		return err
 	}
 
 	data, err := json.Marshal(state)
 	if err != nil {
-		return fmt.Errorf("failed to marshal state: %v", err)
+		return fmt.Errorf("failed to marshal state: %w", err)
 	}
 
-	statePath := filepath.Join(stateDir, "state.json")
-	if err := os.WriteFile(statePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write state file: %v", err)
+	if err := writeFileAtomic(statePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
 	}
 
 	return nil
 }
+
+// writeFileAtomic replaces path with data so readers see either the old or
+// the new content, even after a crash
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// StateLock is the lock of a container's state
+type StateLock struct {
+	file *os.File
+}
+
+// Lock takes the exclusive lock of a container's state, waiting for other
+// simcon invocations to release it. State changing operations hold it from
+// loading the state until they saved it.
+func (m *StateManager) Lock(id string) (*StateLock, error) {
+	return m.lock(id, unix.LOCK_EX)
+}
+
+// TryLock takes the lock of a container's state like Lock, but reports false
+// instead of waiting when another simcon invocation holds it
+func (m *StateManager) TryLock(id string) (*StateLock, bool, error) {
+	lock, err := m.lock(id, unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return lock, true, nil
+}
+
+// lock flocks the state directory of a container
+func (m *StateManager) lock(id string, how int) (*StateLock, error) {
+	path, err := m.dir(id)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("container %s: %w", id, ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state directory: %w", err)
+	}
+	if err := unix.Flock(int(dir.Fd()), how); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to lock state: %w", os.NewSyscallError("flock", err))
+	}
+	return &StateLock{file: dir}, nil
+}
+
+// Unlock releases the lock
+func (l *StateLock) Unlock() error {
+	return l.file.Close()
+}
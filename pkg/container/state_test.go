@@ -0,0 +1,87 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "abc"},
+		{id: "a1_b-c.d+e"},
+		{id: "0"},
+		{id: strings.Repeat("a", maxIDLength)},
+		{id: "", wantErr: true},
+		{id: ".", wantErr: true},
+		{id: "..", wantErr: true},
+		{id: "a/b", wantErr: true},
+		{id: "../a", wantErr: true},
+		{id: "-a", wantErr: true},
+		{id: ".a", wantErr: true},
+		{id: "a b", wantErr: true},
+		{id: "a\x00b", wantErr: true},
+		{id: "é", wantErr: true},
+		{id: strings.Repeat("a", maxIDLength+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := validateID(tt.id)
+		if tt.wantErr && err == nil {
+			t.Errorf("validateID(%q) succeeded, want an error", tt.id)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("validateID(%q) failed: %v", tt.id, err)
+		}
+	}
+}
+
+func TestJoinInRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "abc", want: "/run/simcon/abc"},
+		{name: "a/b", want: "/run/simcon/a/b"},
+		{name: "a/../b", want: "/run/simcon/b"},
+		{name: "..a", want: "/run/simcon/..a"},
+		{name: "", wantErr: true},
+		{name: ".", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "a/..", wantErr: true},
+		{name: "../a", wantErr: true},
+		{name: "../simcon2/a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := joinInRoot("/run/simcon", tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("joinInRoot(%q) = %s, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("joinInRoot(%q) failed: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("joinInRoot(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStateManagerDir(t *testing.T) {
+	m := &StateManager{RootDir: "/run/simcon"}
+	for _, id := range []string{"", "..", "a/b", "../a"} {
+		if dir, err := m.dir(id); err == nil {
+			t.Errorf("dir(%q) = %s, want an error", id, dir)
+		}
+	}
+	if dir, err := m.dir("abc"); err != nil || dir != "/run/simcon/abc" {
+		t.Errorf("dir(%q) = %s, %v, want /run/simcon/abc", "abc", dir, err)
+	}
+}
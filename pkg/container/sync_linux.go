@@ -0,0 +1,277 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncMsg is a message exchanged between the runtime and the init process
+// over the sync socket while the container is created
+type syncMsg byte
+
+const (
+	// syncResume tells the init it was placed in its cgroup and mapped
+	syncResume syncMsg = iota + 1
+	// syncMountsReady tells the runtime the mounts are in place before pivoting
+	syncMountsReady
+	// syncHooksDone tells the init the runtime ran its create hooks
+	syncHooksDone
+	// syncCreated tells the runtime the init waits for start
+	syncCreated
+	// syncError tells the runtime the init failed, followed by the error
+	syncError
+)
+
+// String returns the name of the message
+func (m syncMsg) String() string {
+	switch m {
+	case syncResume:
+		return "resume"
+	case syncMountsReady:
+		return "mounts-ready"
+	case syncHooksDone:
+		return "hooks-done"
+	case syncCreated:
+		return "created"
+	case syncError:
+		return "error"
+	}
+	return "unknown(" + strconv.Itoa(int(m)) + ")"
+}
+
+// initError is an error of the init process as it is sent to the runtime.
+// It unwraps to what the runtime can still tell from it: the system call the
+// kernel refused and whether the spec was invalid.
+type initError struct {
+	Message     string        `json:"message"`
+	Syscall     string        `json:"syscall,omitempty"`
+	Errno       syscall.Errno `json:"errno,omitempty"`
+	InvalidSpec bool          `json:"invalidSpec,omitempty"`
+}
+
+func (e *initError) Error() string {
+	return e.Message
+}
+
+func (e *initError) Unwrap() []error {
+	var errs []error
+	if e.Syscall != "" {
+		errs = append(errs, os.NewSyscallError(e.Syscall, e.Errno))
+	}
+	if e.InvalidSpec {
+		errs = append(errs, ErrInvalidSpec)
+	}
+	return errs
+}
+
+// newInitError flattens err for the runtime
+func newInitError(err error) *initError {
+	e := &initError{
+		Message:     err.Error(),
+		InvalidSpec: errors.Is(err, ErrInvalidSpec),
+	}
+	var syscallErr *os.SyscallError
+	var pathErr *os.PathError
+	if errors.As(err, &e.Errno) {
+		switch {
+		case errors.As(err, &syscallErr):
+			e.Syscall = syscallErr.Syscall
+		case errors.As(err, &pathErr):
+			e.Syscall = pathErr.Op
+		}
+	}
+	return e
+}
+
+// writeSync sends msg to the other side
+func writeSync(f *os.File, msg syncMsg) error {
+	if _, err := f.Write([]byte{byte(msg)}); err != nil {
+		// A failed init sends its error before it exits
+		if errors.Is(err, unix.EPIPE) {
+			if initErr := readError(f); initErr != nil {
+				return initErr
+			}
+		}
+		return fmt.Errorf("failed to send %s: %w", msg, err)
+	}
+	return nil
+}
+
+// readSync waits for msg from the other side. When the init sends an error
+// instead, that error is returned.
+func readSync(f *os.File, want syncMsg) error {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("peer exited while waiting for %s", want)
+		}
+		return fmt.Errorf("failed to wait for %s: %w", want, err)
+	}
+	got := syncMsg(buf[0])
+	if got == syncError {
+		return decodeError(f)
+	}
+	if got != want {
+		return fmt.Errorf("got %s while waiting for %s", got, want)
+	}
+	return nil
+}
+
+// sendError sends err to the runtime
+func sendError(f *os.File, err error) {
+	data, jsonErr := json.Marshal(newInitError(err))
+	if jsonErr != nil {
+		return
+	}
+	f.Write(append([]byte{byte(syncError)}, data...))
+}
+
+// readError reads the error an init sent before it exited, if any
+func readError(f *os.File) error {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(f, buf); err != nil || syncMsg(buf[0]) != syncError {
+		return nil
+	}
+	return decodeError(f)
+}
+
+// decodeError decodes the error following syncError
+func decodeError(f *os.File) error {
+	var initErr initError
+	if err := json.NewDecoder(f).Decode(&initErr); err != nil {
+		return fmt.Errorf("failed to read init error: %w", err)
+	}
+	return &initErr
+}
+
+// createExecFifo creates the fifo the init waits on until start and returns
+// an O_PATH descriptor for the init to open it through
+func createExecFifo(path string) (*os.File, error) {
+	if err := unix.Mkfifo(path, 0622); err != nil {
+		return nil, fmt.Errorf("failed to create exec fifo: %w", os.NewSyscallError("mkfifo", err))
+	}
+	// The umask may have masked the write bits the init needs in a user namespace
+	if err := os.Chmod(path, 0622); err != nil {
+		return nil, fmt.Errorf("failed to chmod exec fifo: %w", err)
+	}
+
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exec fifo: %w", os.NewSyscallError("open", err))
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// initFailed returns the error the init reported before it exited in place
+// of err, which the runtime then ran into
+func (p *InitProcess) initFailed(err error) error {
+	if p.sync == nil || !processExited(p.Container.Process.ID) {
+		return err
+	}
+	if initErr := readError(p.sync); initErr != nil {
+		return initErr
+	}
+	return err
+}
+
+// ReportError sends err to the runtime while it waits for the init to set
+// up, so create fails with the error rather than with the init exiting
+func (p *InitProcess) ReportError(err error) {
+	if p.sync == nil {
+		return
+	}
+	sendError(p.sync, err)
+	p.sync.Close()
+	p.sync = nil
+}
+
+// waitForStart tells the runtime the container is created and blocks until
+// the start operation opens the exec fifo. The fifo is closed when the
+// container process is executed, which lets start return.
+func (p *InitProcess) waitForStart() error {
+	if err := writeSync(p.sync, syncCreated); err != nil {
+		return err
+	}
+	p.sync.Close()
+	p.sync = nil
+
+	fifo, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", p.execFifo.Fd()), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open exec fifo: %w", err)
+	}
+	p.execFifo.Close()
+	p.execFifo = fifo
+
+	// The bundle is not reachable inside the container
+	p.Container.State.Status = StateCreated
+	return p.Container.executeHooksIn("startContainer", p.Container.Spec.Hooks.StartContainer, "/")
+}
+
+// waitForExec opens the exec fifo, which releases the init, and waits until
+// it executed the container process. The init writes a byte right before the
+// exec, which closes the fifo, so it reports whether the byte came before the
+// fifo closed. The init may have died before it opened the fifo, so its exit
+// ends the wait as well.
+func waitForExec(path string, pid int, startTime uint64) (bool, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to open exec fifo: %w", os.NewSyscallError("open", err))
+	}
+	defer unix.Close(fd)
+
+	// Without pidfds we poll the fifo with a timeout and check the init in
+	// between
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	timeout := -1
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	switch {
+	case err == nil:
+		defer unix.Close(pidfd)
+		fds = append(fds, unix.PollFd{Fd: int32(pidfd), Events: unix.POLLIN})
+	case errors.Is(err, unix.ENOSYS):
+		timeout = 100
+	case !errors.Is(err, unix.ESRCH):
+		return false, fmt.Errorf("failed to open pidfd: %w", os.NewSyscallError("pidfd_open", err))
+	}
+	if !isProcess(pid, startTime) {
+		return false, nil
+	}
+
+	started := false
+	buf := make([]byte, 1)
+	for {
+		if _, err := unix.Poll(fds, timeout); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return false, fmt.Errorf("failed to wait for exec: %w", os.NewSyscallError("poll", err))
+		}
+
+		if fds[0].Revents != 0 {
+			n, err := unix.Read(fd, buf)
+			switch {
+			case errors.Is(err, unix.EAGAIN):
+			case err != nil:
+				return false, fmt.Errorf("failed to wait for exec: %w", os.NewSyscallError("read", err))
+			case n == 0:
+				return started, os.Remove(path)
+			default:
+				started = true
+			}
+			continue
+		}
+
+		// The fifo has nothing to read while the init exited, so it never
+		// opened it or died holding it open in a process of its own
+		if (len(fds) > 1 && fds[1].Revents != 0) || (timeout > 0 && !isProcess(pid, startTime)) {
+			return false, nil
+		}
+	}
+}
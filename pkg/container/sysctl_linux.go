@@ -0,0 +1,81 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ipcSysctls are the sysctls namespaced by the IPC namespace
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.msg_next_id":     true,
+	"kernel.sem":             true,
+	"kernel.sem_next_id":     true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_next_id":     true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// utsSysctls are the sysctls namespaced by the UTS namespace
+var utsSysctls = map[string]bool{
+	"kernel.hostname":   true,
+	"kernel.domainname": true,
+}
+
+// sysctlNamespace returns the namespace a sysctl belongs to, or an error
+// when it is not namespaced and would change the host
+func sysctlNamespace(key string) (specs.LinuxNamespaceType, error) {
+	key = strings.ReplaceAll(key, "/", ".")
+	switch {
+	case ipcSysctls[key] || strings.HasPrefix(key, "fs.mqueue."):
+		return specs.IPCNamespace, nil
+	case utsSysctls[key]:
+		return specs.UTSNamespace, nil
+	case strings.HasPrefix(key, "net."):
+		return specs.NetworkNamespace, nil
+	}
+	return "", fmt.Errorf("sysctl %s is not namespaced and would change the host", key)
+}
+
+// validateSysctl checks that every sysctl is namespaced by a namespace the
+// container creates. A namespace joined by path may be shared with the host.
+func validateSysctl(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		return nil
+	}
+
+	for key := range spec.Linux.Sysctl {
+		nsType, err := sysctlNamespace(key)
+		if err != nil {
+			return err
+		}
+		if !ownsNamespace(spec, nsType) {
+			return fmt.Errorf("sysctl %s requires a private %s namespace", key, nsType)
+		}
+	}
+	return nil
+}
+
+// setupSysctl writes the sysctls below /proc/sys. It runs after pivoting and
+// before /proc/sys is made read-only.
+func (p *InitProcess) setupSysctl() error {
+	if err := validateSysctl(p.Container.Spec); err != nil {
+		return err
+	}
+
+	for key, value := range p.Container.Spec.Linux.Sysctl {
+		path := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set sysctl %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package container
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateSysctl(t *testing.T) {
+	private := func(types ...specs.LinuxNamespaceType) []specs.LinuxNamespace {
+		var namespaces []specs.LinuxNamespace
+		for _, nsType := range types {
+			namespaces = append(namespaces, specs.LinuxNamespace{Type: nsType})
+		}
+		return namespaces
+	}
+	joined := []specs.LinuxNamespace{{Type: specs.NetworkNamespace, Path: "/var/run/netns/x"}}
+	all := private(specs.IPCNamespace, specs.UTSNamespace, specs.NetworkNamespace)
+
+	tests := []struct {
+		name       string
+		key        string
+		namespaces []specs.LinuxNamespace
+		wantErr    bool
+	}{
+		{"uts", "kernel.hostname", private(specs.UTSNamespace), false},
+		{"uts without namespace", "kernel.hostname", nil, true},
+		{"uts in another namespace", "kernel.domainname", private(specs.IPCNamespace), true},
+		{"ipc", "kernel.shmmax", private(specs.IPCNamespace), false},
+		{"ipc next id", "kernel.msg_next_id", private(specs.IPCNamespace), false},
+		{"ipc next id without namespace", "kernel.sem_next_id", nil, true},
+		{"ipc slashes", "kernel/shm_next_id", private(specs.IPCNamespace), false},
+		{"mqueue", "fs.mqueue.msg_max", private(specs.IPCNamespace), false},
+		{"net", "net.ipv4.ip_forward", private(specs.NetworkNamespace), false},
+		{"net without namespace", "net.ipv4.ip_forward", nil, true},
+		{"net in a joined namespace", "net.ipv4.ip_forward", joined, true},
+		{"not namespaced", "kernel.panic", all, true},
+		{"not namespaced fs", "fs.file-max", all, true},
+		{"vm", "vm.swappiness", all, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &specs.Spec{Linux: &specs.Linux{
+				Namespaces: tt.namespaces,
+				Sysctl:     map[string]string{tt.key: "1"},
+			}}
+			err := validateSysctl(spec)
+			if tt.wantErr && err == nil {
+				t.Errorf("validateSysctl(%s) succeeded, want an error", tt.key)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validateSysctl(%s) failed: %v", tt.key, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// passwdEntry is a line of /etc/passwd
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+// groupEntry is a line of /etc/group
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// readColonFile calls fn with the fields of every entry of a colon separated file.
+// A missing file has no entries.
+func readColonFile(path string, fn func(fields []string) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(strings.Split(line, ":")); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parsePasswd reads the entries of a passwd file
+func parsePasswd(path string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := readColonFile(path, func(fields []string) error {
+		if len(fields) < 6 {
+			return nil
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uint32(uid), gid: uint32(gid), home: fields[5]})
+		return nil
+	})
+	return entries, err
+}
+
+// parseGroup reads the entries of a group file
+func parseGroup(path string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := readColonFile(path, func(fields []string) error {
+		if len(fields) < 4 {
+			return nil
+		}
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: uint32(gid), members: members})
+		return nil
+	})
+	return entries, err
+}
+
+// resolveUser fills in the process user from the container's /etc/passwd and
+// /etc/group and returns the user's home directory. It must run after pivoting.
+func (p *InitProcess) resolveUser() (string, error) {
+	specUser := p.Container.Spec.Process.User
+	user := p.Container.Process.User
+
+	passwd, err := parsePasswd("/etc/passwd")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /etc/passwd: %w", err)
+	}
+
+	home := "/"
+	if specUser.Username != "" {
+		var found bool
+		for _, e := range passwd {
+			if e.name == specUser.Username {
+				user.UID, user.GID, home, found = e.uid, e.gid, e.home, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("user %q not found in /etc/passwd", specUser.Username)
+		}
+
+		groups, err := parseGroup("/etc/group")
+		if err != nil {
+			return "", fmt.Errorf("failed to read /etc/group: %w", err)
+		}
+		for _, g := range groups {
+			for _, member := range g.members {
+				if member == specUser.Username && g.gid != user.GID {
+					user.AdditionalGids = append(user.AdditionalGids, g.gid)
+				}
+			}
+		}
+		return home, nil
+	}
+
+	for _, e := range passwd {
+		if e.uid == user.UID {
+			home = e.home
+			break
+		}
+	}
+	return home, nil
+}
+
+// setgroupsDenied reports whether setgroups(2) is disabled in our user namespace
+func setgroupsDenied() bool {
+	data, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(data)) == "deny"
+}
+
+// setupUser switches to the process user and applies the umask
+func (p *InitProcess) setupUser() error {
+	home, err := p.resolveUser()
+	if err != nil {
+		return err
+	}
+	user := p.Container.Process.User
+
+	gids := make([]int, len(user.AdditionalGids))
+	for i, gid := range user.AdditionalGids {
+		gids[i] = int(gid)
+	}
+	if len(gids) > 0 || !setgroupsDenied() {
+		if err := unix.Setgroups(gids); err != nil {
+			return fmt.Errorf("failed to set additional groups: %w", os.NewSyscallError("setgroups", err))
+		}
+	}
+
+	if err := unix.Setresgid(int(user.GID), int(user.GID), int(user.GID)); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", user.GID, os.NewSyscallError("setresgid", err))
+	}
+	if err := unix.Setresuid(int(user.UID), int(user.UID), int(user.UID)); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", user.UID, os.NewSyscallError("setresuid", err))
+	}
+
+	if umask := p.Container.Spec.Process.User.Umask; umask != nil {
+		unix.Umask(int(*umask))
+	}
+
+	if !hasEnv(p.Container.Process.Env, "HOME") {
+		p.Container.Process.Env = append(p.Container.Process.Env, "HOME="+home)
+	}
+	return nil
+}
+
+// hasEnv reports whether env sets the variable key
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
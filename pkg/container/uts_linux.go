@@ -0,0 +1,66 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// validateHostname checks that the hostname and domainname are only set with
+// a private UTS namespace, as they would change the host's otherwise
+func validateHostname(spec *specs.Spec) error {
+	if spec.Hostname == "" && spec.Domainname == "" {
+		return nil
+	}
+	if !ownsNamespace(spec, specs.UTSNamespace) {
+		return fmt.Errorf("hostname and domainname require a private uts namespace")
+	}
+	return nil
+}
+
+// SetupHostname sets the container hostname and domainname. It runs after
+// pivoting so /etc/hostname of the container can be updated.
+func (p *InitProcess) SetupHostname() error {
+	spec := p.Container.Spec
+	if !ownsNamespace(spec, specs.UTSNamespace) {
+		return nil
+	}
+
+	if spec.Hostname != "" {
+		if err := unix.Sethostname([]byte(spec.Hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %w", os.NewSyscallError("sethostname", err))
+		}
+		if err := writeHostnameFile(spec.Hostname); err != nil {
+			return err
+		}
+	}
+
+	if spec.Domainname != "" {
+		if err := unix.Setdomainname([]byte(spec.Domainname)); err != nil {
+			return fmt.Errorf("failed to set domainname: %w", os.NewSyscallError("setdomainname", err))
+		}
+	}
+	return nil
+}
+
+// writeHostnameFile updates /etc/hostname when the container has one and may
+// change it
+func writeHostnameFile(hostname string) error {
+	if _, err := os.Stat("/etc/hostname"); err != nil {
+		return nil
+	}
+
+	err := os.WriteFile("/etc/hostname", []byte(hostname+"\n"), 0644)
+	if errors.Is(err, unix.EROFS) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+		logrus.Debugf("not updating /etc/hostname: %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update /etc/hostname: %w", err)
+	}
+	return nil
+}
@@ -7,6 +7,10 @@ import (
 	"syscall"
 )
 
+// RootDir is the root directory of the runtime, holding what it must find
+// again after a reboot
+var RootDir = "/var/lib/simcon"
+
 // FileSystem handles container filesystem operations
 type FileSystem struct {
 	RootPath string
@@ -15,14 +19,14 @@ type FileSystem struct {
 // NewFileSystem creates a new filesystem manager
 func NewFileSystem(containerID string) *FileSystem {
 	return &FileSystem{
-		RootPath: filepath.Join("/var/lib/simcon", containerID),
+		RootPath: filepath.Join(RootDir, containerID),
 	}
 }
 
 // CreateRootFS creates the root filesystem for the container
 func (fs *FileSystem) CreateRootFS() error {
 	if err := os.MkdirAll(fs.RootPath, 0755); err != nil {
-		return fmt.Errorf("failed to create rootfs: %v", err)
+		return fmt.Errorf("failed to create rootfs: %w", err)
 	}
 
 	// Create basic directory structure
@@ -39,7 +43,7 @@ func (fs *FileSystem) CreateRootFS() error {
 	for _, dir := range dirs {
 		path := filepath.Join(fs.RootPath, dir)
 		if err := os.MkdirAll(path, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %v", dir, err)
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
 
@@ -49,13 +53,13 @@ func (fs *FileSystem) CreateRootFS() error {
 // MountProc mounts the proc filesystem
 func (fs *FileSystem) MountProc() error {
 	procPath := filepath.Join(fs.RootPath, "proc")
-	return syscall.Mount("proc", procPath, "proc", 0, "")
+	return os.NewSyscallError("mount", syscall.Mount("proc", procPath, "proc", 0, ""))
 }
 
 // MountSys mounts the sys filesystem
 func (fs *FileSystem) MountSys() error {
 	sysPath := filepath.Join(fs.RootPath, "sys")
-	return syscall.Mount("sysfs", sysPath, "sysfs", 0, "")
+	return os.NewSyscallError("mount", syscall.Mount("sysfs", sysPath, "sysfs", 0, ""))
 }
 
 // Cleanup removes the container filesystem
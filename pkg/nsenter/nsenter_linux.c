@@ -0,0 +1,164 @@
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <sched.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <grp.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+/* Environment set by the runtime for the init process */
+#define NSPATHS_ENV "_SIMCON_NSPATHS"
+#define NSUNSHARE_ENV "_SIMCON_NSUNSHARE"
+#define NSSYNC_ENV "_SIMCON_NSSYNC"
+
+static void bail(const char *fmt, ...)
+{
+	va_list args;
+
+	fprintf(stderr, "nsenter: ");
+	va_start(args, fmt);
+	vfprintf(stderr, fmt, args);
+	va_end(args);
+	fprintf(stderr, "\n");
+	exit(1);
+}
+
+/* report_pid tells the runtime the PID of the process that continues as init */
+static void report_pid(int fd, pid_t pid)
+{
+	char buf[32];
+	int len;
+
+	len = snprintf(buf, sizeof(buf), "%d\n", pid);
+	if (write(fd, buf, len) != len)
+		bail("failed to report pid: %s", strerror(errno));
+}
+
+/*
+ * map_user has the runtime write the id mappings of the user namespace we
+ * just created and waits until it is done. Then we become the root of the
+ * namespace, if it is mapped, so the init keeps its capabilities on exec.
+ */
+static void map_user(int fd)
+{
+	const char msg[] = "idmap\n";
+	char ack;
+
+	if (write(fd, msg, sizeof(msg) - 1) != sizeof(msg) - 1)
+		bail("failed to request id mappings: %s", strerror(errno));
+	if (read(fd, &ack, 1) != 1)
+		bail("failed to wait for id mappings");
+
+	if (setresgid(0, 0, 0) < 0 && errno != EINVAL)
+		bail("failed to become root group: %s", strerror(errno));
+	if (setresuid(0, 0, 0) < 0 && errno != EINVAL)
+		bail("failed to become root user: %s", strerror(errno));
+	/* setgroups is denied to unprivileged runtimes */
+	if (setgroups(0, NULL) < 0 && errno != EPERM)
+		bail("failed to drop supplementary groups: %s", strerror(errno));
+}
+
+/*
+ * nsenter joins the namespaces listed in NSPATHS_ENV as comma separated
+ * "<clone flag>:<path>" pairs, in order, and only then creates the new
+ * namespaces in NSUNSHARE_ENV. A new user namespace would otherwise own
+ * us before the joins and make them fail, so it is created first among the
+ * new ones and the runtime maps it before the others are created inside it.
+ * Joining or creating a PID namespace only affects children, so in that
+ * case we fork and the child continues as the init while the parent waits
+ * for it and mirrors its exit status.
+ */
+void nsenter(void)
+{
+	const char *paths, *unshare_env, *sync_env;
+	char *list, *entry, *saveptr;
+	int unshare_flags = 0, fork_pid = 0, sync_fd = -1;
+	pid_t child;
+	int status;
+
+	paths = getenv(NSPATHS_ENV);
+	if (paths == NULL || *paths == '\0')
+		return;
+
+	unshare_env = getenv(NSUNSHARE_ENV);
+	if (unshare_env != NULL && *unshare_env != '\0')
+		unshare_flags = atoi(unshare_env);
+	sync_env = getenv(NSSYNC_ENV);
+	if (sync_env != NULL && *sync_env != '\0')
+		sync_fd = atoi(sync_env);
+
+	list = strdup(paths);
+	if (list == NULL)
+		bail("failed to copy namespace paths");
+
+	for (entry = strtok_r(list, ",", &saveptr); entry != NULL; entry = strtok_r(NULL, ",", &saveptr)) {
+		char *path = strchr(entry, ':');
+		int flag, fd;
+
+		if (path == NULL)
+			bail("invalid namespace entry %s", entry);
+		*path++ = '\0';
+		flag = atoi(entry);
+
+		fd = open(path, O_RDONLY | O_CLOEXEC);
+		if (fd < 0)
+			bail("failed to open %s: %s", path, strerror(errno));
+		if (setns(fd, flag) < 0)
+			bail("failed to join namespace %s: %s", path, strerror(errno));
+		close(fd);
+
+		if (flag == CLONE_NEWPID)
+			fork_pid = 1;
+	}
+	free(list);
+
+	if (unshare_flags & CLONE_NEWUSER) {
+		if (sync_fd < 0)
+			bail("no sync descriptor to map the user namespace");
+		if (unshare(CLONE_NEWUSER) < 0)
+			bail("failed to create user namespace: %s", strerror(errno));
+		map_user(sync_fd);
+		unshare_flags &= ~CLONE_NEWUSER;
+	}
+	if (unshare_flags != 0 && unshare(unshare_flags) < 0)
+		bail("failed to create namespaces: %s", strerror(errno));
+	if (unshare_flags & CLONE_NEWPID)
+		fork_pid = 1;
+
+	/* Tell the Go side the namespaces were joined */
+	unsetenv(NSPATHS_ENV);
+	unsetenv(NSUNSHARE_ENV);
+	unsetenv(NSSYNC_ENV);
+
+	if (!fork_pid) {
+		if (sync_fd >= 0)
+			close(sync_fd);
+		return;
+	}
+
+	child = fork();
+	if (child < 0)
+		bail("failed to fork into pid namespace: %s", strerror(errno));
+	if (child == 0) {
+		if (sync_fd >= 0)
+			close(sync_fd);
+		return;
+	}
+
+	if (sync_fd >= 0) {
+		report_pid(sync_fd, child);
+		close(sync_fd);
+	}
+
+	while (waitpid(child, &status, 0) < 0) {
+		if (errno != EINTR)
+			bail("failed to wait for init: %s", strerror(errno));
+	}
+	if (WIFSIGNALED(status))
+		exit(128 + WTERMSIG(status));
+	exit(WEXITSTATUS(status));
+}
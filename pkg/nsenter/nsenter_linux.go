@@ -0,0 +1,16 @@
+//go:build linux && cgo
+
+// Package nsenter joins existing namespaces before the Go runtime starts.
+// setns(2) refuses to move a multithreaded process into a user or mount
+// namespace, so the init process does it from a C constructor instead.
+// Import it for its side effects.
+package nsenter
+
+/*
+#cgo CFLAGS: -Wall
+extern void nsenter(void);
+void __attribute__((constructor)) init(void) {
+	nsenter();
+}
+*/
+import "C"
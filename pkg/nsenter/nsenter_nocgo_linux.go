@@ -0,0 +1,6 @@
+//go:build linux && !cgo
+
+// Package nsenter joins existing namespaces before the Go runtime starts.
+// Without cgo there is no C constructor to do it, so an init process that
+// was asked to join namespaces fails its setup instead.
+package nsenter
@@ -0,0 +1,136 @@
+package seccomp
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// label identifies a position in a program that jumps can target
+type label int
+
+// next makes a conditional jump fall through to the following instruction
+const next label = -1
+
+// instruction is a BPF instruction whose jump targets are still labels
+type instruction struct {
+	filter unix.SockFilter
+	jt     label
+	jf     label
+	ja     label
+}
+
+// program assembles a classic BPF program with forward jumps to labels
+type program struct {
+	insns  []instruction
+	labels []int
+}
+
+// newLabel allocates a label that must be bound before assembling
+func (p *program) newLabel() label {
+	p.labels = append(p.labels, -1)
+	return label(len(p.labels) - 1)
+}
+
+// bind places l at the next instruction
+func (p *program) bind(l label) {
+	p.labels[l] = len(p.insns)
+}
+
+// stmt appends a non-jump instruction
+func (p *program) stmt(code uint16, k uint32) {
+	p.insns = append(p.insns, instruction{
+		filter: unix.SockFilter{Code: code, K: k},
+		jt:     next,
+		jf:     next,
+		ja:     next,
+	})
+}
+
+// jump appends a conditional jump comparing the accumulator with k
+func (p *program) jump(op uint16, k uint32, jt, jf label) {
+	p.insns = append(p.insns, instruction{
+		filter: unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, K: k},
+		jt:     jt,
+		jf:     jf,
+		ja:     next,
+	})
+}
+
+// jumpAlways appends an unconditional jump to l
+func (p *program) jumpAlways(l label) {
+	p.insns = append(p.insns, instruction{
+		filter: unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA},
+		jt:     next,
+		jf:     next,
+		ja:     l,
+	})
+}
+
+// splice appends an already assembled program
+func (p *program) splice(filters []unix.SockFilter) {
+	for _, f := range filters {
+		p.insns = append(p.insns, instruction{filter: f, jt: next, jf: next, ja: next})
+	}
+}
+
+// loadWord loads the 32-bit word at offset of struct seccomp_data
+func (p *program) loadWord(offset uint32) {
+	p.stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset)
+}
+
+// ret appends a return of the given seccomp action
+func (p *program) ret(action uint32) {
+	p.stmt(unix.BPF_RET|unix.BPF_K, action)
+}
+
+// assemble resolves labels into jump offsets
+func (p *program) assemble() ([]unix.SockFilter, error) {
+	if len(p.insns) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("program has %d instructions, the limit is %d", len(p.insns), unix.BPF_MAXINSNS)
+	}
+
+	offset := func(pos int, l label) (int, error) {
+		if l == next {
+			return 0, nil
+		}
+		target := p.labels[l]
+		if target < 0 {
+			return 0, fmt.Errorf("unbound label %d", l)
+		}
+		off := target - pos - 1
+		if off < 0 {
+			return 0, fmt.Errorf("backward jump at instruction %d", pos)
+		}
+		return off, nil
+	}
+
+	filters := make([]unix.SockFilter, len(p.insns))
+	for i, insn := range p.insns {
+		f := insn.filter
+		if f.Code&0x07 == unix.BPF_JMP && (insn.jt != next || insn.jf != next || insn.ja != next) {
+			if f.Code&0xf0 == unix.BPF_JA {
+				off, err := offset(i, insn.ja)
+				if err != nil {
+					return nil, err
+				}
+				f.K = uint32(off)
+			} else {
+				jt, err := offset(i, insn.jt)
+				if err != nil {
+					return nil, err
+				}
+				jf, err := offset(i, insn.jf)
+				if err != nil {
+					return nil, err
+				}
+				if jt > 255 || jf > 255 {
+					return nil, fmt.Errorf("jump at instruction %d is out of range", i)
+				}
+				f.Jt, f.Jf = uint8(jt), uint8(jf)
+			}
+		}
+		filters[i] = f
+	}
+	return filters, nil
+}
@@ -0,0 +1,427 @@
+package seccomp
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+//go:generate go run mksyscalls.go
+
+// Offsets of the fields of struct seccomp_data
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// x32SyscallBit marks x32 ABI syscalls on x86_64, whose audit architecture
+// x32 shares
+const x32SyscallBit = 0x40000000
+
+// arch describes how an architecture presents syscalls to seccomp
+type arch struct {
+	auditArch uint32
+	table     string
+	is64Bit   bool
+	bigEndian bool
+}
+
+// arches maps OCI architecture names to their seccomp description
+var arches = map[specs.Arch]arch{
+	specs.ArchX86:     {unix.AUDIT_ARCH_I386, "386", false, false},
+	specs.ArchX86_64:  {unix.AUDIT_ARCH_X86_64, "amd64", true, false},
+	specs.ArchX32:     {unix.AUDIT_ARCH_X86_64, "x32", false, false},
+	specs.ArchARM:     {unix.AUDIT_ARCH_ARM, "arm", false, false},
+	specs.ArchAARCH64: {unix.AUDIT_ARCH_AARCH64, "arm64", true, false},
+	specs.ArchPPC64:   {unix.AUDIT_ARCH_PPC64, "ppc64", true, true},
+	specs.ArchPPC64LE: {unix.AUDIT_ARCH_PPC64LE, "ppc64le", true, false},
+	specs.ArchS390X:   {unix.AUDIT_ARCH_S390X, "s390x", true, true},
+	specs.ArchRISCV64: {unix.AUDIT_ARCH_RISCV64, "riscv64", true, false},
+}
+
+// nativeArches maps a GOARCH to its OCI architecture name
+var nativeArches = map[string]specs.Arch{
+	"386":     specs.ArchX86,
+	"amd64":   specs.ArchX86_64,
+	"arm":     specs.ArchARM,
+	"arm64":   specs.ArchAARCH64,
+	"ppc64":   specs.ArchPPC64,
+	"ppc64le": specs.ArchPPC64LE,
+	"s390x":   specs.ArchS390X,
+	"riscv64": specs.ArchRISCV64,
+}
+
+// filterFlags maps OCI filter flag names to seccomp(2) flags
+var filterFlags = map[specs.LinuxSeccompFlag]uint{
+	specs.LinuxSeccompFlagLog:              unix.SECCOMP_FILTER_FLAG_LOG,
+	specs.LinuxSeccompFlagSpecAllow:        unix.SECCOMP_FILTER_FLAG_SPEC_ALLOW,
+	specs.LinuxSeccompFlagWaitKillableRecv: unix.SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV,
+	"SECCOMP_FILTER_FLAG_TSYNC":            unix.SECCOMP_FILTER_FLAG_TSYNC,
+}
+
+// Filter is a compiled seccomp program ready to be loaded
+type Filter struct {
+	Program []unix.SockFilter
+	Flags   uint
+}
+
+// Compile translates the OCI seccomp configuration into a classic BPF program
+func Compile(config *specs.LinuxSeccomp) (*Filter, error) {
+	defaultAction, err := action(config.DefaultAction, config.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action: %w", err)
+	}
+	if defaultAction == unix.SECCOMP_RET_USER_NOTIF {
+		return nil, fmt.Errorf("%s cannot be the default action", specs.ActNotify)
+	}
+
+	var flags uint
+	for _, f := range config.Flags {
+		flag, ok := filterFlags[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown seccomp flag %q", f)
+		}
+		flags |= flag
+	}
+	if config.ListenerPath != "" {
+		flags |= unix.SECCOMP_FILTER_FLAG_NEW_LISTENER
+	}
+
+	// Like libseccomp, always filter the native architecture, the runtime
+	// itself execs the container process with it
+	native, ok := nativeArches[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	names := append([]specs.Arch{native}, config.Architectures...)
+
+	// x32 goes last, the x86_64 filter jumps forward to it
+	var targets []arch
+	var x32 *arch
+	seen := make(map[specs.Arch]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		a, ok := arches[name]
+		if !ok {
+			logrus.Warnf("seccomp architecture %s is not supported, ignoring", name)
+			continue
+		}
+		if name == specs.ArchX32 {
+			x32 = &a
+			continue
+		}
+		targets = append(targets, a)
+	}
+	if x32 != nil {
+		targets = append(targets, *x32)
+	}
+
+	p := &program{}
+
+	// Dispatch on the architecture, killing the process for any we do not
+	// filter. Architectures sharing an audit architecture are dispatched to
+	// the first of them.
+	p.loadWord(offsetArch)
+	archLabels := make([]label, len(targets))
+	dispatched := make(map[uint32]bool)
+	for i, a := range targets {
+		archLabels[i] = p.newLabel()
+		if dispatched[a.auditArch] {
+			continue
+		}
+		dispatched[a.auditArch] = true
+		skip := p.newLabel()
+		p.jump(unix.BPF_JEQ, a.auditArch, next, skip)
+		p.jumpAlways(archLabels[i])
+		p.bind(skip)
+	}
+	p.ret(unix.SECCOMP_RET_KILL_PROCESS)
+
+	// Syscalls of the x86_64 ABI missing from the profile are killed
+	kill := p.newLabel()
+	x32Label := kill
+	if x32 != nil {
+		x32Label = archLabels[len(targets)-1]
+	}
+
+	for i, a := range targets {
+		p.bind(archLabels[i])
+		p.loadWord(offsetNr)
+		switch a.table {
+		case "amd64":
+			// x32 syscalls go on to the x32 filter
+			cont := p.newLabel()
+			p.jump(unix.BPF_JGE, x32SyscallBit, next, cont)
+			p.jumpAlways(x32Label)
+			p.bind(cont)
+		case "x32":
+			// Reached from the dispatch when x86_64 is not filtered
+			cont := p.newLabel()
+			p.jump(unix.BPF_JGE, x32SyscallBit, cont, next)
+			p.jumpAlways(kill)
+			p.bind(cont)
+		}
+		if err := compileArch(p, a, config.Syscalls, defaultAction, config.ListenerPath); err != nil {
+			return nil, err
+		}
+	}
+	p.bind(kill)
+	p.ret(unix.SECCOMP_RET_KILL_PROCESS)
+
+	filters, err := p.assemble()
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble seccomp program: %w", err)
+	}
+	return &Filter{Program: filters, Flags: flags}, nil
+}
+
+// compileArch emits the syscall dispatch for a single architecture, with
+// the syscall number loaded
+func compileArch(p *program, a arch, syscalls []specs.LinuxSyscall, defaultAction uint32, listenerPath string) error {
+	table := syscallTables[a.table]
+
+	// Group the rules by syscall number, keeping the order they were given in
+	var order []uint32
+	rules := make(map[uint32][]specs.LinuxSyscall)
+	for _, sc := range syscalls {
+		for _, name := range sc.Names {
+			nr, ok := table[name]
+			if !ok {
+				logrus.Debugf("seccomp: syscall %s is unknown on %s, ignoring", name, a.table)
+				continue
+			}
+			if _, seen := rules[nr]; !seen {
+				order = append(order, nr)
+			}
+			rules[nr] = append(rules[nr], sc)
+		}
+	}
+
+	for _, nr := range order {
+		block, err := compileSyscall(a, rules[nr], defaultAction, listenerPath)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			continue
+		}
+
+		if len(block) <= 255 {
+			p.splice([]unix.SockFilter{{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: uint8(len(block)), K: nr}})
+		} else {
+			p.splice([]unix.SockFilter{
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: nr},
+				{Code: unix.BPF_JMP | unix.BPF_JA, K: uint32(len(block))},
+			})
+		}
+		p.splice(block)
+	}
+
+	p.ret(defaultAction)
+	return nil
+}
+
+// compileSyscall emits the rules of a single syscall. Every path through
+// the block returns, so the rules are free to clobber the accumulator.
+func compileSyscall(a arch, rules []specs.LinuxSyscall, defaultAction uint32, listenerPath string) ([]unix.SockFilter, error) {
+	p := &program{}
+	emitted := false
+
+	for _, rule := range rules {
+		act, err := action(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action for %v: %w", rule.Names, err)
+		}
+		if act == defaultAction {
+			continue
+		}
+		if act == unix.SECCOMP_RET_USER_NOTIF && listenerPath == "" {
+			return nil, fmt.Errorf("%s requires a listenerPath", specs.ActNotify)
+		}
+		emitted = true
+
+		nextRule := p.newLabel()
+		for _, arg := range rule.Args {
+			if err := compileArg(p, a, arg, nextRule); err != nil {
+				return nil, fmt.Errorf("invalid argument for %v: %w", rule.Names, err)
+			}
+		}
+		p.ret(act)
+		p.bind(nextRule)
+	}
+
+	if !emitted {
+		return nil, nil
+	}
+	p.ret(defaultAction)
+	return p.assemble()
+}
+
+// compileArg emits a comparison of one syscall argument that jumps to fail
+// when it does not hold and falls through when it does
+func compileArg(p *program, a arch, arg specs.LinuxSeccompArg, fail label) error {
+	if arg.Index > 5 {
+		return fmt.Errorf("argument index %d out of range", arg.Index)
+	}
+
+	lo := uint32(offsetArgs + 8*arg.Index)
+	hi := lo + 4
+	if a.bigEndian {
+		lo, hi = hi, lo
+	}
+
+	value, valueTwo := arg.Value, arg.ValueTwo
+	pass := p.newLabel()
+
+	if !a.is64Bit {
+		// 32-bit architectures only pass the low word, the high word is always zero
+		hiValue, hiValueTwo := uint32(value>>32), uint32(valueTwo>>32)
+		switch arg.Op {
+		case specs.OpEqualTo, specs.OpGreaterThan, specs.OpGreaterEqual:
+			if hiValue != 0 {
+				p.jumpAlways(fail)
+				return nil
+			}
+		case specs.OpMaskedEqual:
+			if hiValueTwo != 0 {
+				p.jumpAlways(fail)
+				return nil
+			}
+		case specs.OpNotEqual, specs.OpLessThan, specs.OpLessEqual:
+			if hiValue != 0 {
+				return nil
+			}
+		}
+		p.loadWord(lo)
+		if err := compareWord(p, arg.Op, uint32(value), uint32(valueTwo), pass, fail); err != nil {
+			return err
+		}
+		p.bind(pass)
+		return nil
+	}
+
+	switch arg.Op {
+	case specs.OpEqualTo, specs.OpMaskedEqual:
+		p.loadWord(hi)
+		if err := compareWord(p, arg.Op, uint32(value>>32), uint32(valueTwo>>32), next, fail); err != nil {
+			return err
+		}
+		p.loadWord(lo)
+		if err := compareWord(p, arg.Op, uint32(value), uint32(valueTwo), pass, fail); err != nil {
+			return err
+		}
+	case specs.OpNotEqual:
+		p.loadWord(hi)
+		p.jump(unix.BPF_JEQ, uint32(value>>32), next, pass)
+		p.loadWord(lo)
+		p.jump(unix.BPF_JEQ, uint32(value), fail, pass)
+	case specs.OpGreaterThan, specs.OpGreaterEqual:
+		p.loadWord(hi)
+		p.jump(unix.BPF_JGT, uint32(value>>32), pass, next)
+		p.jump(unix.BPF_JEQ, uint32(value>>32), next, fail)
+		p.loadWord(lo)
+		if err := compareWord(p, arg.Op, uint32(value), 0, pass, fail); err != nil {
+			return err
+		}
+	case specs.OpLessThan, specs.OpLessEqual:
+		p.loadWord(hi)
+		p.jump(unix.BPF_JGT, uint32(value>>32), fail, next)
+		p.jump(unix.BPF_JEQ, uint32(value>>32), next, pass)
+		p.loadWord(lo)
+		if err := compareWord(p, arg.Op, uint32(value), 0, pass, fail); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown operator %q", arg.Op)
+	}
+
+	p.bind(pass)
+	return nil
+}
+
+// compareWord compares the accumulator with a 32-bit value. For masked
+// equality value is the mask and valueTwo the expected result.
+func compareWord(p *program, op specs.LinuxSeccompOperator, value, valueTwo uint32, pass, fail label) error {
+	switch op {
+	case specs.OpEqualTo:
+		p.jump(unix.BPF_JEQ, value, pass, fail)
+	case specs.OpNotEqual:
+		p.jump(unix.BPF_JEQ, value, fail, pass)
+	case specs.OpMaskedEqual:
+		p.stmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, value)
+		p.jump(unix.BPF_JEQ, valueTwo, pass, fail)
+	case specs.OpGreaterThan:
+		p.jump(unix.BPF_JGT, value, pass, fail)
+	case specs.OpGreaterEqual:
+		p.jump(unix.BPF_JGE, value, pass, fail)
+	case specs.OpLessThan:
+		p.jump(unix.BPF_JGE, value, fail, pass)
+	case specs.OpLessEqual:
+		p.jump(unix.BPF_JGT, value, fail, pass)
+	default:
+		return fmt.Errorf("unknown operator %q", op)
+	}
+	return nil
+}
+
+// action converts an OCI seccomp action into a seccomp return value
+func action(act specs.LinuxSeccompAction, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		if *errnoRet > unix.SECCOMP_RET_DATA {
+			return 0, fmt.Errorf("errnoRet %d out of range", *errnoRet)
+		}
+		errno = uint32(*errnoRet)
+	}
+
+	switch act {
+	case specs.ActKill, specs.ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case specs.ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case specs.ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case specs.ActErrno:
+		return unix.SECCOMP_RET_ERRNO | errno, nil
+	case specs.ActTrace:
+		return unix.SECCOMP_RET_TRACE | errno, nil
+	case specs.ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	case specs.ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	case specs.ActNotify:
+		return unix.SECCOMP_RET_USER_NOTIF, nil
+	}
+	return 0, fmt.Errorf("unknown action %q", act)
+}
+
+// Load installs the filter on the calling thread with seccomp(2). It returns
+// the user notification fd when the filter has a listener and -1 otherwise.
+func Load(filter *Filter) (int, error) {
+	if len(filter.Program) == 0 {
+		return -1, fmt.Errorf("empty seccomp program")
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter.Program)),
+		Filter: &filter.Program[0],
+	}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, uintptr(filter.Flags), uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to load seccomp filter: %w", os.NewSyscallError("seccomp", errno))
+	}
+
+	if filter.Flags&unix.SECCOMP_FILTER_FLAG_NEW_LISTENER == 0 {
+		return -1, nil
+	}
+	return int(r), nil
+}
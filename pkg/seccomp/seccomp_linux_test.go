@@ -0,0 +1,377 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// run interprets a classic BPF program over a struct seccomp_data
+func run(t *testing.T, prog []unix.SockFilter, data []byte, order binary.ByteOrder) uint32 {
+	t.Helper()
+
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		f := prog[pc]
+		cond := false
+		switch f.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = order.Uint32(data[f.K:])
+			continue
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= f.K
+			continue
+		case unix.BPF_RET | unix.BPF_K:
+			return f.K
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(f.K)
+			continue
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			cond = acc == f.K
+		case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+			cond = acc > f.K
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			cond = acc >= f.K
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", f.Code, pc)
+		}
+		if cond {
+			pc += int(f.Jt)
+		} else {
+			pc += int(f.Jf)
+		}
+	}
+	t.Fatalf("program ran past its end")
+	return 0
+}
+
+// seccompData lays out a struct seccomp_data for the architecture
+func seccompData(a arch, nr uint32, args ...uint64) ([]byte, binary.ByteOrder) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if a.bigEndian {
+		order = binary.BigEndian
+	}
+
+	data := make([]byte, offsetArgs+8*6)
+	order.PutUint32(data[offsetNr:], nr)
+	order.PutUint32(data[offsetArch:], a.auditArch)
+	for i, arg := range args {
+		order.PutUint64(data[offsetArgs+8*i:], arg)
+	}
+	return data, order
+}
+
+func TestAction(t *testing.T) {
+	errno := uint(unix.EACCES)
+	tooLarge := uint(unix.SECCOMP_RET_DATA + 1)
+
+	tests := []struct {
+		act      specs.LinuxSeccompAction
+		errnoRet *uint
+		want     uint32
+		wantErr  bool
+	}{
+		{act: specs.ActKill, want: unix.SECCOMP_RET_KILL_THREAD},
+		{act: specs.ActKillThread, want: unix.SECCOMP_RET_KILL_THREAD},
+		{act: specs.ActKillProcess, want: unix.SECCOMP_RET_KILL_PROCESS},
+		{act: specs.ActTrap, want: unix.SECCOMP_RET_TRAP},
+		{act: specs.ActErrno, want: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+		{act: specs.ActErrno, errnoRet: &errno, want: unix.SECCOMP_RET_ERRNO | uint32(unix.EACCES)},
+		{act: specs.ActErrno, errnoRet: &tooLarge, wantErr: true},
+		{act: specs.ActTrace, errnoRet: &errno, want: unix.SECCOMP_RET_TRACE | uint32(unix.EACCES)},
+		{act: specs.ActAllow, want: unix.SECCOMP_RET_ALLOW},
+		{act: specs.ActLog, want: unix.SECCOMP_RET_LOG},
+		{act: specs.ActNotify, want: unix.SECCOMP_RET_USER_NOTIF},
+		{act: "SCMP_ACT_BOGUS", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := action(tt.act, tt.errnoRet)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("action(%s) = %#x, want an error", tt.act, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("action(%s) failed: %v", tt.act, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("action(%s) = %#x, want %#x", tt.act, got, tt.want)
+		}
+	}
+}
+
+func TestCompileArg(t *testing.T) {
+	const (
+		pass = unix.SECCOMP_RET_ALLOW
+		fail = unix.SECCOMP_RET_ERRNO
+	)
+	amd64 := arches[specs.ArchX86_64]
+	s390x := arches[specs.ArchS390X]
+	i386 := arches[specs.ArchX86]
+
+	tests := []struct {
+		name  string
+		arch  arch
+		arg   specs.LinuxSeccompArg
+		input uint64
+		want  uint32
+	}{
+		{"eq", amd64, specs.LinuxSeccompArg{Index: 1, Value: 0x100000002, Op: specs.OpEqualTo}, 0x100000002, pass},
+		{"eq high word differs", amd64, specs.LinuxSeccompArg{Index: 1, Value: 0x100000002, Op: specs.OpEqualTo}, 0x2, fail},
+		{"eq low word differs", amd64, specs.LinuxSeccompArg{Index: 1, Value: 0x100000002, Op: specs.OpEqualTo}, 0x100000003, fail},
+		{"ne", amd64, specs.LinuxSeccompArg{Index: 0, Value: 0x100000002, Op: specs.OpNotEqual}, 0x2, pass},
+		{"ne equal", amd64, specs.LinuxSeccompArg{Index: 0, Value: 0x100000002, Op: specs.OpNotEqual}, 0x100000002, fail},
+		{"gt by high word", amd64, specs.LinuxSeccompArg{Index: 2, Value: 0xffffffff, Op: specs.OpGreaterThan}, 0x100000000, pass},
+		{"gt equal", amd64, specs.LinuxSeccompArg{Index: 2, Value: 0x100000005, Op: specs.OpGreaterThan}, 0x100000005, fail},
+		{"gt smaller high word", amd64, specs.LinuxSeccompArg{Index: 2, Value: 0x100000000, Op: specs.OpGreaterThan}, 0xffffffff, fail},
+		{"ge equal", amd64, specs.LinuxSeccompArg{Index: 2, Value: 0x100000005, Op: specs.OpGreaterEqual}, 0x100000005, pass},
+		{"ge smaller", amd64, specs.LinuxSeccompArg{Index: 2, Value: 0x100000005, Op: specs.OpGreaterEqual}, 0x100000004, fail},
+		{"lt by high word", amd64, specs.LinuxSeccompArg{Index: 3, Value: 0x100000000, Op: specs.OpLessThan}, 0xffffffff, pass},
+		{"lt equal", amd64, specs.LinuxSeccompArg{Index: 3, Value: 0x100000000, Op: specs.OpLessThan}, 0x100000000, fail},
+		{"le equal", amd64, specs.LinuxSeccompArg{Index: 3, Value: 0x100000000, Op: specs.OpLessEqual}, 0x100000000, pass},
+		{"le larger", amd64, specs.LinuxSeccompArg{Index: 3, Value: 0x100000000, Op: specs.OpLessEqual}, 0x100000001, fail},
+		{"masked eq", amd64, specs.LinuxSeccompArg{Index: 4, Value: 0xff000000ff, ValueTwo: 0x1200000034, Op: specs.OpMaskedEqual}, 0x1233333334, pass},
+		{"masked eq high word differs", amd64, specs.LinuxSeccompArg{Index: 4, Value: 0xff000000ff, ValueTwo: 0x1200000034, Op: specs.OpMaskedEqual}, 0x1333333334, fail},
+		{"masked eq low word differs", amd64, specs.LinuxSeccompArg{Index: 4, Value: 0xff000000ff, ValueTwo: 0x1200000034, Op: specs.OpMaskedEqual}, 0x1233333335, fail},
+		{"big endian eq", s390x, specs.LinuxSeccompArg{Index: 5, Value: 0x100000002, Op: specs.OpEqualTo}, 0x100000002, pass},
+		{"big endian eq swapped words", s390x, specs.LinuxSeccompArg{Index: 5, Value: 0x100000002, Op: specs.OpEqualTo}, 0x200000001, fail},
+		{"32-bit eq", i386, specs.LinuxSeccompArg{Index: 0, Value: 7, Op: specs.OpEqualTo}, 7, pass},
+		{"32-bit eq high value never matches", i386, specs.LinuxSeccompArg{Index: 0, Value: 0x100000007, Op: specs.OpEqualTo}, 7, fail},
+		{"32-bit ne high value always matches", i386, specs.LinuxSeccompArg{Index: 0, Value: 0x100000007, Op: specs.OpNotEqual}, 7, pass},
+		{"32-bit lt high value always matches", i386, specs.LinuxSeccompArg{Index: 0, Value: 0x100000000, Op: specs.OpLessThan}, 0xffffffff, pass},
+		{"32-bit gt", i386, specs.LinuxSeccompArg{Index: 0, Value: 7, Op: specs.OpGreaterThan}, 8, pass},
+		{"32-bit gt high value never matches", i386, specs.LinuxSeccompArg{Index: 0, Value: 0x100000000, Op: specs.OpGreaterThan}, 0xffffffff, fail},
+		{"32-bit masked eq", i386, specs.LinuxSeccompArg{Index: 0, Value: 0xf0, ValueTwo: 0x30, Op: specs.OpMaskedEqual}, 0x3f, pass},
+		{"32-bit masked eq high expected never matches", i386, specs.LinuxSeccompArg{Index: 0, Value: 0xf0, ValueTwo: 0x100000030, Op: specs.OpMaskedEqual}, 0x3f, fail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &program{}
+			failLabel := p.newLabel()
+			if err := compileArg(p, tt.arch, tt.arg, failLabel); err != nil {
+				t.Fatalf("compileArg failed: %v", err)
+			}
+			p.ret(pass)
+			p.bind(failLabel)
+			p.ret(fail)
+			prog, err := p.assemble()
+			if err != nil {
+				t.Fatalf("assemble failed: %v", err)
+			}
+
+			args := make([]uint64, 6)
+			args[tt.arg.Index] = tt.input
+			data, order := seccompData(tt.arch, 0, args...)
+			if got := run(t, prog, data, order); got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileArgErrors(t *testing.T) {
+	amd64 := arches[specs.ArchX86_64]
+	for _, arg := range []specs.LinuxSeccompArg{
+		{Index: 6, Op: specs.OpEqualTo},
+		{Index: 0, Op: "SCMP_CMP_BOGUS"},
+	} {
+		p := &program{}
+		if err := compileArg(p, amd64, arg, p.newLabel()); err == nil {
+			t.Errorf("compileArg(%+v) succeeded, want an error", arg)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	amd64 := arches[specs.ArchX86_64]
+	table := syscallTables[amd64.table]
+	errno := uint(unix.EACCES)
+
+	filter, err := Compile(&specs.LinuxSeccomp{
+		DefaultAction:   specs.ActErrno,
+		DefaultErrnoRet: &errno,
+		Architectures:   []specs.Arch{specs.ArchX86_64},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read", "not_a_syscall"}, Action: specs.ActAllow},
+			{Names: []string{"write"}, Action: specs.ActAllow, Args: []specs.LinuxSeccompArg{{Index: 0, Value: 1, Op: specs.OpEqualTo}}},
+			{Names: []string{"close"}, Action: specs.ActErrno, ErrnoRet: &errno, Args: []specs.LinuxSeccompArg{{Index: 0, Value: 2, Op: specs.OpEqualTo}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	denied := unix.SECCOMP_RET_ERRNO | uint32(unix.EACCES)
+	tests := []struct {
+		name string
+		arch uint32
+		nr   uint32
+		arg  uint64
+		want uint32
+	}{
+		{"allowed", amd64.auditArch, table["read"], 0, unix.SECCOMP_RET_ALLOW},
+		{"allowed by argument", amd64.auditArch, table["write"], 1, unix.SECCOMP_RET_ALLOW},
+		{"argument does not match", amd64.auditArch, table["write"], 2, denied},
+		{"rule with the default action", amd64.auditArch, table["close"], 2, denied},
+		{"not listed", amd64.auditArch, table["openat"], 0, denied},
+		{"x32 syscall", amd64.auditArch, table["read"] | x32SyscallBit, 0, unix.SECCOMP_RET_KILL_PROCESS},
+		{"other architecture", unix.AUDIT_ARCH_I386, table["read"], 0, unix.SECCOMP_RET_KILL_PROCESS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, order := seccompData(arch{auditArch: tt.arch}, tt.nr, tt.arg)
+			if got := run(t, filter.Program, data, order); got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileX32(t *testing.T) {
+	amd64 := arches[specs.ArchX86_64]
+	x32 := arches[specs.ArchX32]
+
+	filter, err := Compile(&specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Architectures: []specs.Arch{specs.ArchX86_64, specs.ArchX32},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read", "ioctl"}, Action: specs.ActAllow},
+			{Names: []string{"write"}, Action: specs.ActAllow, Args: []specs.LinuxSeccompArg{{Index: 0, Value: 1, Op: specs.OpEqualTo}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	denied := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	tests := []struct {
+		name string
+		arch arch
+		nr   uint32
+		arg  uint64
+		want uint32
+	}{
+		{"x86_64 syscall", amd64, syscallTables["amd64"]["read"], 0, unix.SECCOMP_RET_ALLOW},
+		{"x86_64 not listed", amd64, syscallTables["amd64"]["openat"], 0, denied},
+		{"x32 syscall", x32, syscallTables["x32"]["read"], 0, unix.SECCOMP_RET_ALLOW},
+		{"x32 own number", x32, syscallTables["x32"]["ioctl"], 0, unix.SECCOMP_RET_ALLOW},
+		{"x32 x86_64 number", x32, syscallTables["amd64"]["ioctl"] | x32SyscallBit, 0, denied},
+		{"x32 argument", x32, syscallTables["x32"]["write"], 1, unix.SECCOMP_RET_ALLOW},
+		{"x32 argument does not match", x32, syscallTables["x32"]["write"], 2, denied},
+		{"x32 not listed", x32, syscallTables["x32"]["openat"], 0, denied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, order := seccompData(tt.arch, tt.nr, tt.arg)
+			if got := run(t, filter.Program, data, order); got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileNativeArch(t *testing.T) {
+	native, ok := nativeArches[runtime.GOARCH]
+	if !ok {
+		t.Skipf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	a := arches[native]
+
+	// A profile without the native architecture still filters it
+	filter, err := Compile(&specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Architectures: []specs.Arch{specs.ArchMIPS},
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"openat"}, Action: specs.ActErrno}},
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	data, order := seccompData(a, syscallTables[a.table]["openat"])
+	if got, want := run(t, filter.Program, data, order), unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM); got != want {
+		t.Errorf("openat: got %#x, want %#x", got, want)
+	}
+	data, order = seccompData(a, syscallTables[a.table]["read"])
+	if got := run(t, filter.Program, data, order); got != unix.SECCOMP_RET_ALLOW {
+		t.Errorf("read: got %#x, want %#x", got, unix.SECCOMP_RET_ALLOW)
+	}
+}
+
+func TestCompileLongJumps(t *testing.T) {
+	amd64 := arches[specs.ArchX86_64]
+	table := syscallTables[amd64.table]
+
+	// Each 64-bit equality takes five instructions, so the block of write
+	// is too long for a conditional jump over it
+	var syscalls []specs.LinuxSyscall
+	for i := uint(0); i < 100; i++ {
+		errno := i + 1
+		syscalls = append(syscalls, specs.LinuxSyscall{
+			Names:    []string{"write"},
+			Action:   specs.ActErrno,
+			ErrnoRet: &errno,
+			Args:     []specs.LinuxSeccompArg{{Index: 0, Value: uint64(i), Op: specs.OpEqualTo}},
+		})
+	}
+	syscalls = append(syscalls, specs.LinuxSyscall{Names: []string{"read"}, Action: specs.ActErrno})
+
+	filter, err := Compile(&specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Architectures: []specs.Arch{specs.ArchX86_64},
+		Syscalls:      syscalls,
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		nr   uint32
+		arg  uint64
+		want uint32
+	}{
+		{"first rule", table["write"], 0, unix.SECCOMP_RET_ERRNO | 1},
+		{"last rule", table["write"], 99, unix.SECCOMP_RET_ERRNO | 100},
+		{"no rule matches", table["write"], 100, unix.SECCOMP_RET_ALLOW},
+		{"syscall after the long block", table["read"], 0, unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+		{"not listed", table["openat"], 0, unix.SECCOMP_RET_ALLOW},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, order := seccompData(amd64, tt.nr, tt.arg)
+			if got := run(t, filter.Program, data, order); got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config specs.LinuxSeccomp
+	}{
+		{"notify as default", specs.LinuxSeccomp{DefaultAction: specs.ActNotify}},
+		{"unknown default action", specs.LinuxSeccomp{DefaultAction: "SCMP_ACT_BOGUS"}},
+		{"unknown flag", specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Flags: []specs.LinuxSeccompFlag{"SECCOMP_FILTER_FLAG_BOGUS"}}},
+		{"notify without listener", specs.LinuxSeccomp{
+			DefaultAction: specs.ActAllow,
+			Architectures: []specs.Arch{specs.ArchX86_64},
+			Syscalls:      []specs.LinuxSyscall{{Names: []string{"read"}, Action: specs.ActNotify}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(&tt.config); err == nil {
+				t.Error("Compile succeeded, want an error")
+			}
+		})
+	}
+}